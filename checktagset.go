@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/tiling"
+	log "github.com/sirupsen/logrus"
+)
+
+type tagOccurrence struct {
+	tag   tagID
+	chrom int
+	pos   int
+	rev   bool
+}
+
+type tagsetChecker struct {
+	tagLibraryFile string
+	refFile        string
+
+	chroms      []string
+	occurrences []tagOccurrence // in reference order
+	count       []int           // count[tag] is the number of occurrences of tag
+	first       []int           // first[tag] is the index in occurrences of the first occurrence of tag
+}
+
+func (cmd *tagsetChecker) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	flags.StringVar(&cmd.tagLibraryFile, "tag-library", "", "tag library fasta `file`")
+	flags.StringVar(&cmd.refFile, "ref", "", "reference fasta `file`")
+	outputFilename := flags.String("o", "-", "output `file` for report (tsv)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.tagLibraryFile == "" {
+		err = errors.New("tag library (-tag-library) not specified")
+		return 2
+	} else if cmd.refFile == "" {
+		err = errors.New("reference data (-ref) not specified")
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning check-tagset",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.refFile)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"check-tagset", "-local=true", "-tag-library", cmd.tagLibraryFile, "-ref", cmd.refFile, "-o", "/mnt/output/report.tsv"}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/report.tsv")
+		return 0
+	}
+
+	taglib, err := loadTagLibrary(cmd.tagLibraryFile)
+	if err != nil {
+		return 1
+	}
+	err = cmd.findTags(taglib)
+	if err != nil {
+		return 1
+	}
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	bufw := bufio.NewWriter(output)
+	missing, duplicated, outOfOrder, err := cmd.report(bufw, taglib.Len())
+	if err != nil {
+		return 1
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	log.Printf("%d tags: %d missing, %d duplicated, %d out of order", taglib.Len(), missing, duplicated, outOfOrder)
+	if missing+duplicated+outOfOrder > 0 {
+		err = errors.New("tag library is not suitable for tiling this reference")
+		return 1
+	}
+	return 0
+}
+
+// findTags records all occurrences of tags in the reference, on
+// either strand.
+func (cmd *tagsetChecker) findTags(taglib *tiling.TagLibrary) error {
+	f, err := os.Open(cmd.refFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(cmd.refFile, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: gzip: %s", cmd.refFile, err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+	cmd.count = make([]int, taglib.Len())
+	cmd.first = make([]int, taglib.Len())
+	fr := tiling.NewFastaReader(in)
+	for {
+		label, err := fr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", cmd.refFile, err)
+		}
+		seq, err := ioutil.ReadAll(fr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", cmd.refFile, err)
+		}
+		chrom := len(cmd.chroms)
+		cmd.chroms = append(cmd.chroms, strings.SplitN(label, " ", 2)[0])
+		log.Debugf("%s: finding tags", cmd.chroms[chrom])
+		taglib.FindAll(bytes.ToLower(seq), func(id tagID, pos, taglen int, rev bool) {
+			if cmd.count[id] == 0 {
+				cmd.first[id] = len(cmd.occurrences)
+			}
+			cmd.count[id]++
+			cmd.occurrences = append(cmd.occurrences, tagOccurrence{tag: id, chrom: chrom, pos: pos, rev: rev})
+		})
+	}
+	return f.Close()
+}
+
+// report writes one line for each tag that is missing from the
+// reference, occurs more than once, or is out of order, and returns
+// the number of tags with each kind of problem.
+//
+// A minimal set of out-of-order tags is found by taking the longest
+// run of unique tags whose IDs increase along the reference; every
+// other unique tag is out of order.
+func (cmd *tagsetChecker) report(w io.Writer, ntags int) (missing, duplicated, outOfOrder int, err error) {
+	var unique []tagOccurrence
+	for _, occ := range cmd.occurrences {
+		if cmd.count[occ.tag] == 1 {
+			unique = append(unique, occ)
+		}
+	}
+	inOrder := make([]bool, ntags)
+	for _, idx := range longestIncreasing(unique) {
+		inOrder[unique[idx].tag] = true
+	}
+
+	_, err = fmt.Fprint(w, "tag\tproblem\tdetail\n")
+	for tag := 0; tag < ntags && err == nil; tag++ {
+		switch {
+		case cmd.count[tag] == 0:
+			missing++
+			_, err = fmt.Fprintf(w, "%d\tmissing\t\n", tag)
+		case cmd.count[tag] > 1:
+			duplicated++
+			_, err = fmt.Fprintf(w, "%d\tduplicated\t%d occurrences, first at %s\n", tag, cmd.count[tag], cmd.position(cmd.occurrences[cmd.first[tag]]))
+		case !inOrder[tag]:
+			outOfOrder++
+			_, err = fmt.Fprintf(w, "%d\tout-of-order\t%s\n", tag, cmd.position(cmd.occurrences[cmd.first[tag]]))
+		}
+	}
+	return
+}
+
+// position returns a human-readable (1-based) position, with "(-)"
+// for reverse strand occurrences.
+func (cmd *tagsetChecker) position(occ tagOccurrence) string {
+	s := fmt.Sprintf("%s:%d", cmd.chroms[occ.chrom], occ.pos+1)
+	if occ.rev {
+		s += " (-)"
+	}
+	return s
+}
+
+// longestIncreasing returns the indices of a longest subsequence of
+// occs whose tag IDs are strictly increasing.
+func longestIncreasing(occs []tagOccurrence) []int {
+	// tails[i] is the index (in occs) of the smallest tag that
+	// ends an increasing subsequence of length i+1
+	var tails []int
+	prev := make([]int, len(occs))
+	for i, occ := range occs {
+		n := sort.Search(len(tails), func(j int) bool { return occs[tails[j]].tag >= occ.tag })
+		if n > 0 {
+			prev[i] = tails[n-1]
+		} else {
+			prev[i] = -1
+		}
+		if n == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[n] = i
+		}
+	}
+	ret := make([]int, len(tails))
+	for i, j := len(tails)-1, -1; i >= 0; i-- {
+		if j < 0 {
+			j = tails[len(tails)-1]
+		} else {
+			j = prev[j]
+		}
+		ret[i] = j
+	}
+	return ret
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/arvados/lightning/tiling"
+	"gopkg.in/check.v1"
+)
+
+type checktagsetSuite struct{}
+
+var _ = check.Suite(&checktagsetSuite{})
+
+func (s *checktagsetSuite) TestCheckTagset(c *check.C) {
+	tempdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempdir)
+
+	tags := []string{
+		"ggagaactgtgctccgccttcaga",
+		"acacatgctagcgcgtcggggtgg",
+		"gactctagcagagtggccagccac",
+		"cctcccgagccgagccacccgtca",
+		"gttattaataataacttatcatca",
+	}
+	err = ioutil.WriteFile(tempdir+"/tags", []byte(">0000.00\n"+strings.Join(tags, "\n")+"\n"), 0644)
+	c.Assert(err, check.IsNil)
+	filler := "cccccccccccccccccccc"
+
+	// All tags, in order
+	err = ioutil.WriteFile(tempdir+"/good.fa", []byte(">chr1\n"+tags[0]+filler+tags[1]+filler+tags[2]+"\n>chr2\n"+tags[3]+filler+"\n"+tags[4]+"\n"), 0644)
+	c.Assert(err, check.IsNil)
+	var report bytes.Buffer
+	exited := (&tagsetChecker{}).RunCommand("check-tagset", []string{"-local=true", "-tag-library", tempdir + "/tags", "-ref", tempdir + "/good.fa"}, &bytes.Buffer{}, &report, os.Stderr)
+	c.Check(exited, check.Equals, 0)
+	c.Check(report.String(), check.Equals, "tag\tproblem\tdetail\n")
+
+	// Tag 1 appears twice (once on the reverse strand), tag 3
+	// appears before tag 2, and tag 4 is missing
+	err = ioutil.WriteFile(tempdir+"/bad.fa", []byte(">chr1\n"+tags[0]+filler+tags[1]+filler+tags[3]+"\n>chr2 description\n"+filler+tags[2]+filler+string(tiling.ReverseComplement([]byte(tags[1])))+"\n"), 0644)
+	c.Assert(err, check.IsNil)
+	report.Reset()
+	exited = (&tagsetChecker{}).RunCommand("check-tagset", []string{"-local=true", "-tag-library", tempdir + "/tags", "-ref", tempdir + "/bad.fa"}, &bytes.Buffer{}, &report, &bytes.Buffer{})
+	c.Check(exited, check.Equals, 1)
+	c.Check(report.String(), check.Equals, `tag	problem	detail
+1	duplicated	2 occurrences, first at chr1:45
+3	out-of-order	chr1:89
+4	missing	
+`)
+}
@@ -20,7 +20,15 @@ var (
 		"vcf2fasta":          &vcf2fasta{},
 		"import":             &importer{},
 		"export-numpy":       &exportNumpy{},
+		"export-fasta":       &exportFasta{},
 		"filter":             &filterer{},
+		"merge":              &merger{},
+		"make-tagset":        &tagsetMaker{},
+		"check-tagset":       &tagsetChecker{},
+		"stats":              &statscmd{},
+		"index-library":      &indexLibrary{},
+		"unindex-library":    &unindexLibrary{},
+		"upgrade-library":    &upgradeLibrary{},
 		"build-docker-image": &buildDockerImage{},
 		"pca":                &pythonPCA{},
 		"plot":               &pythonPlot{},
@@ -45,7 +53,7 @@ func (cmd *buildDockerImage) RunCommand(prog string, args []string, stdin io.Rea
 RUN DEBIAN_FRONTEND=noninteractive \
   apt-get update && \
   apt-get dist-upgrade -y && \
-  apt-get install -y --no-install-recommends bcftools bedtools samtools python2 python3-sklearn python3-matplotlib && \
+  apt-get install -y --no-install-recommends bedtools samtools python2 python3-sklearn python3-matplotlib && \
   apt-get clean
 `), 0644)
 	if err != nil {
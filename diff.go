@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
 	"github.com/arvados/lightning/hgvs"
+	"github.com/arvados/lightning/tiling"
 )
 
 type diffFasta struct{}
@@ -48,15 +49,23 @@ func (cmd *diffFasta) RunCommand(prog string, args []string, stdin io.Reader, st
 				return
 			}
 			defer f.Close()
-			scanner := bufio.NewScanner(f)
-			scanner.Buffer(nil, 640*1024*1024)
-			for scanner.Scan() {
-				buf := scanner.Bytes()
-				if len(buf) > 0 && buf[0] != '>' {
-					fasta[idx] = append(fasta[idx], bytes.ToUpper(buf)...)
+			fr := tiling.NewFastaReader(f)
+			for {
+				_, err := fr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					errs <- err
+					return
 				}
+				seq, err := ioutil.ReadAll(fr)
+				if err != nil {
+					errs <- err
+					return
+				}
+				fasta[idx] = append(fasta[idx], bytes.ToUpper(seq)...)
 			}
-			errs <- scanner.Err()
+			errs <- nil
 		}()
 	}
 	for range flags.Args() {
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	log "github.com/sirupsen/logrus"
+)
+
+type exportFasta struct {
+	tagset    [][]byte
+	maxTagLen int
+	variants  [][][]byte // variants[tag][variantID] is the tile sequence
+	positions map[tagID]tagPosition
+}
+
+func (cmd *exportFasta) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputFilename := flags.String("i", "-", "input `file`")
+	outputFilename := flags.String("o", "-", "output `file`")
+	genomeName := flags.String("genome", "", "export only the genome with the given `name` (default: all genomes)")
+	canonicalPhase := flags.Bool("canonical-phase", false, "write the lower-numbered tile variant of each unphased pair in the first haplotype (default: as imported)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning export-fasta",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         64000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(inputFilename)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"export-fasta", "-local=true", "-i", *inputFilename, "-o", "/mnt/output/export.fasta", "-genome", *genomeName, fmt.Sprintf("-canonical-phase=%v", *canonicalPhase)}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/export.fasta")
+		return 0
+	}
+
+	input, cleanup, err := spoolInput(*inputFilename, stdin)
+	if err != nil {
+		return 1
+	}
+	defer cleanup()
+
+	// First pass: load the tag set and tile sequences.
+	log.Print("reading tile variants")
+	err = decodeLibraryFile(input, cmd.loadTileVariants)
+	if err != nil {
+		return 1
+	}
+	if len(cmd.tagset) == 0 {
+		err = errors.New("cannot export fasta: library does not include a tag set")
+		return 1
+	}
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	bufw := bufio.NewWriter(output)
+
+	// Second pass: write each genome.
+	log.Print("writing genomes")
+	found := false
+	err = decodeLibraryFile(input, func(ent *LibraryEntry) error {
+		for _, cg := range ent.CompactGenomes {
+			if *genomeName != "" && cg.Name != *genomeName {
+				continue
+			}
+			found = true
+			if *canonicalPhase {
+				cg.canonicalPhase()
+			}
+			for hap := 0; hap < 2; hap++ {
+				err := cmd.writeHaplotype(bufw, cg, hap)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 1
+	}
+	if *genomeName != "" && !found {
+		err = fmt.Errorf("genome %q not found", *genomeName)
+		return 1
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func (cmd *exportFasta) loadTileVariants(ent *LibraryEntry) error {
+	if len(ent.TagSet) > 0 && cmd.tagset == nil {
+		cmd.tagset = make([][]byte, len(ent.TagSet))
+		for i, tag := range ent.TagSet {
+			cmd.tagset[i] = bytes.ToLower(tag)
+			if cmd.maxTagLen < len(tag) {
+				cmd.maxTagLen = len(tag)
+			}
+		}
+	}
+	for _, tp := range ent.TagPositions {
+		if cmd.positions == nil {
+			cmd.positions = map[tagID]tagPosition{}
+		}
+		cmd.positions[tp.Tag] = tp
+	}
+	for _, tv := range ent.TileVariants {
+		for len(cmd.variants) <= int(tv.Tag) {
+			cmd.variants = append(cmd.variants, nil)
+		}
+		vars := cmd.variants[tv.Tag]
+		for len(vars) <= int(tv.Variant) {
+			vars = append(vars, nil)
+		}
+		vars[tv.Variant] = tv.Sequence
+		cmd.variants[tv.Tag] = vars
+	}
+	return nil
+}
+
+// writeHaplotype writes one haplotype of the given genome as a fasta
+// record, joining the tile sequences in tag order.
+//
+// Each tile ends with the following tag, so when consecutive tiles
+// are present, the leading tag of the second tile is omitted. A
+// missing (no-call) tile is written as a run of N as long as the
+// reference sequence from its tag to the next tag (see import -ref).
+// If the library has no reference positions for those tags, the
+// length is unknown, and the tile is left out.
+// Partial tiles (see import -partial-tiles) are written as stored,
+// including their no-calls. Missing tiles that are covered by a
+// preceding tile that spans several tags are not written at all.
+func (cmd *exportFasta) writeHaplotype(w io.Writer, cg CompactGenome, hap int) error {
+	_, err := fmt.Fprintf(w, ">%s/%d\n", cg.Name, hap+1)
+	if err != nil {
+		return err
+	}
+	span := make(map[int]int, len(cg.Spans))
+	for _, s := range cg.Spans {
+		span[s.Index] = s.Span
+	}
+	fw := &fastaWriter{w: w, width: 60, keep: cmd.maxTagLen}
+	coveredUntil := 0 // tags before this one are covered by a spanning tile
+	for idx := hap; idx < len(cg.Variants); idx += 2 {
+		tag := tagID(idx / 2)
+		tagseq := cmd.tagset[tag]
+		v := cg.Variants[idx]
+		if v == 0 && int(tag) < coveredUntil {
+			continue
+		} else if n := span[idx]; n > 1 {
+			coveredUntil = int(tag) + n
+		}
+		if v == 0 {
+			n := cmd.noCallLength(tag)
+			if n > 0 && fw.endsWith(tagseq) {
+				n -= len(tagseq)
+			}
+			err = fw.writeNs(n)
+		} else if seq := cmd.tileSequence(tag, v); seq == nil {
+			return fmt.Errorf("genome %q refers to tag %d variant %d, which is not in the library", cg.Name, tag, v)
+		} else {
+			if fw.endsWith(tagseq) && bytes.HasPrefix(seq, tagseq) {
+				seq = seq[len(tagseq):]
+			}
+			_, err = fw.Write(seq)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fw.Close()
+}
+
+// noCallLength returns the number of bases from the start of the
+// given tag to the start of the next tag on the reference, or 0 if
+// that is not known.
+func (cmd *exportFasta) noCallLength(tag tagID) int {
+	tp, ok := cmd.positions[tag]
+	if !ok {
+		return 0
+	}
+	next, ok := cmd.positions[tag+1]
+	if !ok || next.Chrom != tp.Chrom || next.Start <= tp.Start {
+		return 0
+	}
+	return next.Start - tp.Start
+}
+
+func (cmd *exportFasta) tileSequence(tag tagID, variant tileVariantID) []byte {
+	if int(tag) >= len(cmd.variants) || int(variant) >= len(cmd.variants[tag]) {
+		return nil
+	}
+	return cmd.variants[tag][variant]
+}
+
+// fastaWriter writes sequence data with line breaks every width
+// bytes (or no line breaks, if width is 0), and remembers the most
+// recently written bytes.
+type fastaWriter struct {
+	w     io.Writer
+	width int
+	keep  int // number of bytes to remember for endsWith
+	col   int
+	tail  []byte
+}
+
+func (fw *fastaWriter) Write(seq []byte) (int, error) {
+	fw.remember(seq)
+	written := 0
+	for len(seq) > 0 {
+		n := fw.width - fw.col
+		if n > len(seq) || fw.width <= 0 {
+			n = len(seq)
+		}
+		_, err := fw.w.Write(seq[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		seq = seq[n:]
+		fw.col += n
+		if fw.col == fw.width {
+			_, err = fw.w.Write([]byte{'\n'})
+			if err != nil {
+				return written, err
+			}
+			fw.col = 0
+		}
+	}
+	return written, nil
+}
+
+func (fw *fastaWriter) writeNs(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	_, err := fw.Write(bytes.Repeat([]byte{'n'}, n))
+	return err
+}
+
+// remember keeps the last fw.keep bytes written, so endsWith can
+// check whether the output so far ends with a given tag.
+func (fw *fastaWriter) remember(seq []byte) {
+	if len(seq) >= fw.keep {
+		fw.tail = append(fw.tail[:0], seq[len(seq)-fw.keep:]...)
+		return
+	}
+	fw.tail = append(fw.tail, seq...)
+	if len(fw.tail) > fw.keep {
+		fw.tail = append(fw.tail[:0], fw.tail[len(fw.tail)-fw.keep:]...)
+	}
+}
+
+func (fw *fastaWriter) endsWith(seq []byte) bool {
+	return len(seq) > 0 && bytes.HasSuffix(fw.tail, seq)
+}
+
+// Close ends the last line, if needed. It does not close the
+// underlying writer.
+func (fw *fastaWriter) Close() error {
+	if fw.col == 0 {
+		return nil
+	}
+	fw.col = 0
+	_, err := fw.w.Write([]byte{'\n'})
+	return err
+}
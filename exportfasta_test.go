@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type exportFastaSuite struct{}
+
+var _ = check.Suite(&exportFastaSuite{})
+
+func (s *exportFastaSuite) TestRoundTrip(c *check.C) {
+	for _, withRef := range []bool{true, false} {
+		args := []string{"-local=true", "-tag-library", "testdata/tags"}
+		if withRef {
+			args = append(args, "-ref", "testdata/ref")
+		}
+		args = append(args, "testdata/a.1.fasta")
+		var imported bytes.Buffer
+		exited := (&importer{}).RunCommand("import", args, &bytes.Buffer{}, &imported, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+
+		var output bytes.Buffer
+		exited = (&exportFasta{}).RunCommand("export-fasta", []string{"-local=true", "-genome", "testdata/a.1.fasta"}, &imported, &output, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+
+		records := strings.Split(output.String(), ">")
+		c.Assert(records, check.HasLen, 3)
+		for hap, fnm := range []string{"testdata/a.1.fasta", "testdata/a.2.fasta"} {
+			lines := strings.SplitN(records[hap+1], "\n", 2)
+			c.Check(lines[0], check.Equals, fmt.Sprintf("testdata/a.1.fasta/%d", hap+1))
+			for _, line := range strings.Split(lines[1], "\n") {
+				c.Check(len(line) <= 60, check.Equals, true)
+			}
+			buf, err := ioutil.ReadFile(fnm)
+			c.Assert(err, check.IsNil)
+			expect := strings.ToLower(strings.Join(strings.Split(string(buf), "\n")[1:], ""))
+			// Tiles 5 and 6 contain no-calls. With
+			// reference positions, they are replaced with
+			// a run of N from the end of tag 5 to the start
+			// of tag 7 on the reference (264 to 336).
+			// Without, they are left out.
+			tag5 := "gctctcaaaccttgtatttttctt"
+			tag7 := "cctatgagtcaatcctattttcaa"
+			nocalls := 0
+			if withRef {
+				nocalls = 72
+			}
+			expect = expect[:strings.Index(expect, tag5)+len(tag5)] + strings.Repeat("n", nocalls) + expect[strings.Index(expect, tag7):]
+			c.Check(strings.Replace(lines[1], "\n", "", -1), check.Equals, expect, check.Commentf("withRef=%v", withRef))
+		}
+	}
+}
+
+func (s *exportFastaSuite) TestSpanningTile(c *check.C) {
+	tempdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempdir)
+
+	// Change one base of tag 3, so the tile for tag 2 spans tags
+	// 2 and 3.
+	buf, err := ioutil.ReadFile("testdata/a.1.fasta")
+	c.Assert(err, check.IsNil)
+	fasta := strings.Replace(string(buf), "CCTCCCGAGCCGAGCCACCCGTCA", "CCTCCCGAGCTGAGCCACCCGTCA", 1)
+	for _, fnm := range []string{"b.1.fasta", "b.2.fasta"} {
+		err = ioutil.WriteFile(tempdir+"/"+fnm, []byte(fasta), 0644)
+		c.Assert(err, check.IsNil)
+	}
+
+	var imported bytes.Buffer
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", "testdata/ref", tempdir + "/b.1.fasta"}, &bytes.Buffer{}, &imported, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs, _, err := ReadCompactGenomes(bytes.NewReader(imported.Bytes()))
+	c.Assert(err, check.IsNil)
+	c.Assert(cgs, check.HasLen, 1)
+	c.Check(cgs[0].Spans, check.DeepEquals, []TileSpan{{Index: 4, Span: 2}, {Index: 5, Span: 2}})
+	c.Check(cgs[0].Variants[6:8], check.DeepEquals, []tileVariantID{0, 0})
+
+	// The spanning tile is exported in place of tiles 2 and 3,
+	// without a run of N for the missing tile 3.
+	var output bytes.Buffer
+	exited = (&exportFasta{}).RunCommand("export-fasta", []string{"-local=true"}, &imported, &output, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	records := strings.Split(output.String(), ">")
+	c.Assert(records, check.HasLen, 3)
+	expect := strings.ToLower(strings.Join(strings.Split(fasta, "\n")[1:], ""))
+	tag5 := "gctctcaaaccttgtatttttctt"
+	tag7 := "cctatgagtcaatcctattttcaa"
+	expect = expect[:strings.Index(expect, tag5)+len(tag5)] + strings.Repeat("n", 72) + expect[strings.Index(expect, tag7):]
+	lines := strings.SplitN(records[1], "\n", 2)
+	c.Check(strings.Replace(lines[1], "\n", "", -1), check.Equals, expect)
+}
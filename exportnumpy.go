@@ -2,17 +2,18 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
-	"github.com/kshedden/gonpy"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -33,6 +34,8 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 	priority := flags.Int("priority", 500, "container request priority")
 	inputFilename := flags.String("i", "-", "input `file`")
 	outputFilename := flags.String("o", "-", "output `file`")
+	annotationsFilename := flags.String("annotations", "", "write tag and reference position of each column to `file` (tsv)")
+	canonicalPhase := flags.Bool("canonical-phase", false, "put the lower-numbered tile variant of each unphased pair in the first column (default: as imported)")
 	err = flags.Parse(args)
 	if err == flag.ErrHelp {
 		err = nil
@@ -48,7 +51,7 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 	}
 
 	if !*runlocal {
-		if *outputFilename != "-" {
+		if *outputFilename != "-" || *annotationsFilename != "" {
 			err = errors.New("cannot specify output file in container mode: not implemented")
 			return 1
 		}
@@ -56,7 +59,7 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 			Name:        "lightning export-numpy",
 			Client:      arvados.NewClientFromEnv(),
 			ProjectUUID: *projectUUID,
-			RAM:         64000000000,
+			RAM:         16000000000,
 			VCPUs:       2,
 			Priority:    *priority,
 		}
@@ -64,7 +67,7 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 		if err != nil {
 			return 1
 		}
-		runner.Args = []string{"export-numpy", "-local=true", "-i", *inputFilename, "-o", "/mnt/output/library.npy"}
+		runner.Args = []string{"export-numpy", "-local=true", "-i", *inputFilename, "-o", "/mnt/output/library.npy", "-annotations", "/mnt/output/annotations.tsv", fmt.Sprintf("-canonical-phase=%v", *canonicalPhase)}
 		var output string
 		output, err = runner.Run()
 		if err != nil {
@@ -74,37 +77,35 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 		return 0
 	}
 
-	var input io.ReadCloser
-	if *inputFilename == "-" {
-		input = ioutil.NopCloser(stdin)
-	} else {
-		input, err = os.Open(*inputFilename)
-		if err != nil {
-			return 1
-		}
-		defer input.Close()
-	}
-	cgs, err := ReadCompactGenomes(input)
+	input, cleanup, err := spoolInput(*inputFilename, stdin)
 	if err != nil {
 		return 1
 	}
-	err = input.Close()
+	defer cleanup()
+
+	// First pass: find the dimensions of the output array, and
+	// whether the variant IDs fit in uint16.
+	rows, cols := 0, 0
+	var maxVariant tileVariantID
+	var positions []tagPosition
+	err = decodeLibraryFile(input, func(ent *LibraryEntry) error {
+		positions = append(positions, ent.TagPositions...)
+		for _, cg := range ent.CompactGenomes {
+			rows++
+			if cols < len(cg.Variants) {
+				cols = len(cg.Variants)
+			}
+			for _, v := range cg.Variants {
+				if maxVariant < v {
+					maxVariant = v
+				}
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return 1
 	}
-	cols := 0
-	for _, cg := range cgs {
-		if cols < len(cg.Variants) {
-			cols = len(cg.Variants)
-		}
-	}
-	rows := len(cgs)
-	out := make([]uint16, rows*cols)
-	for row, cg := range cgs {
-		for i, v := range cg.Variants {
-			out[row*cols+i] = uint16(v)
-		}
-	}
 
 	var output io.WriteCloser
 	if *outputFilename == "-" {
@@ -117,12 +118,51 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 		defer output.Close()
 	}
 	bufw := bufio.NewWriter(output)
-	npw, err := gonpy.NewWriter(nopCloser{bufw})
+	npw := &npyWriter{w: bufw, dtype: "<u2", shape: []int{rows, cols}}
+	wide := maxVariant > math.MaxUint16
+	if wide {
+		log.Printf("max variant ID is %d, writing uint32 array", maxVariant)
+		npw.dtype = "<u4"
+	}
+	// The rows are written below, one genome at a time.
+	err = npw.WriteHeader()
+	if err != nil {
+		return 1
+	}
+
+	// Second pass: write one row per genome.
+	row16 := make([]uint16, cols)
+	row32 := make([]uint32, cols)
+	err = decodeLibraryFile(input, func(ent *LibraryEntry) error {
+		for _, cg := range ent.CompactGenomes {
+			if *canonicalPhase {
+				cg.canonicalPhase()
+			}
+			for i := range row32 {
+				if i < len(cg.Variants) {
+					row32[i] = uint32(cg.Variants[i])
+				} else {
+					row32[i] = 0
+				}
+			}
+			var err error
+			if wide {
+				err = binary.Write(bufw, binary.LittleEndian, row32)
+			} else {
+				for i, v := range row32 {
+					row16[i] = uint16(v)
+				}
+				err = binary.Write(bufw, binary.LittleEndian, row16)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return 1
 	}
-	npw.Shape = []int{rows, cols}
-	npw.WriteUint16(out)
 	err = bufw.Flush()
 	if err != nil {
 		return 1
@@ -131,11 +171,83 @@ func (cmd *exportNumpy) RunCommand(prog string, args []string, stdin io.Reader,
 	if err != nil {
 		return 1
 	}
+	if *annotationsFilename != "" {
+		err = writeNumpyAnnotations(*annotationsFilename, cols, positions)
+		if err != nil {
+			return 1
+		}
+	}
 	return 0
 }
 
+// writeNumpyAnnotations writes a tsv file with one line for each
+// column of the exported array, giving the tag and (if known) the
+// reference position of the tag.
+func writeNumpyAnnotations(filename string, cols int, positions []tagPosition) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	var pos []tagPosition // pos[tag] is the position of tag
+	for _, tp := range positions {
+		for len(pos) <= int(tp.Tag) {
+			pos = append(pos, tagPosition{})
+		}
+		pos[tp.Tag] = tp
+	}
+	_, err = fmt.Fprint(bufw, "column\ttag\tchrom\tstart\tend\n")
+	for col := 0; col < cols && err == nil; col++ {
+		tag := col / 2
+		var tp tagPosition
+		if tag < len(pos) {
+			tp = pos[tag]
+		}
+		_, err = fmt.Fprintf(bufw, "%d\t%d\t%s\t%d\t%d\n", col, tag, tp.Chrom, tp.Start, tp.End)
+	}
+	if err != nil {
+		return err
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 type nopCloser struct {
 	io.Writer
 }
 
 func (nopCloser) Close() error { return nil }
+
+// npyWriter writes an array in numpy .npy format (version 1.0). The
+// caller writes the array data, in row-major order, after the header.
+type npyWriter struct {
+	w     io.Writer
+	dtype string // e.g., "<u2" for little-endian uint16
+	shape []int
+}
+
+// WriteHeader writes the magic string, version, and header dict. The
+// header is padded with spaces and a newline so the data starts at a
+// multiple of 64 bytes.
+func (npw *npyWriter) WriteHeader() error {
+	shape := ""
+	for _, n := range npw.shape {
+		shape += fmt.Sprintf("%d,", n)
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", npw.dtype, shape)
+	// magic (6) + version (2) + header length (2) + header + "\n"
+	if pad := 64 - (10+len(header)+1)%64; pad < 64 {
+		header += strings.Repeat(" ", pad)
+	}
+	header += "\n"
+	if len(header) > math.MaxUint16 {
+		return fmt.Errorf("npy header too long (%d bytes)", len(header))
+	}
+	buf := append([]byte("\x93NUMPY\x01\x00"), byte(len(header)), byte(len(header)>>8))
+	_, err := npw.w.Write(append(buf, header...))
+	return err
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/kshedden/gonpy"
 	"gopkg.in/check.v1"
@@ -16,9 +19,18 @@ func (s *exportSuite) TestFastaToNumpy(c *check.C) {
 	var buffer bytes.Buffer
 	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", "testdata/ref", "testdata/a.1.fasta"}, &bytes.Buffer{}, &buffer, os.Stderr)
 	c.Assert(exited, check.Equals, 0)
+	tempdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempdir)
 	var output bytes.Buffer
-	exited = (&exportNumpy{}).RunCommand("export-numpy", []string{"-local=true"}, &buffer, &output, os.Stderr)
+	exited = (&exportNumpy{}).RunCommand("export-numpy", []string{"-local=true", "-annotations", tempdir + "/annotations.tsv"}, &buffer, &output, os.Stderr)
 	c.Check(exited, check.Equals, 0)
+	annotations, err := ioutil.ReadFile(tempdir + "/annotations.tsv")
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(string(annotations), "\n")
+	c.Check(lines[0], check.Equals, "column\ttag\tchrom\tstart\tend")
+	c.Check(lines[1], check.Equals, "0\t0\tchr1\t0\t24")
+	c.Check(lines[4], check.Equals, "3\t1\tchr1\t48\t72")
 	npy, err := gonpy.NewReader(&output)
 	c.Assert(err, check.IsNil)
 	variants, err := npy.GetUint16()
@@ -45,3 +57,34 @@ func sortUints(variants []uint16) {
 		}
 	}
 }
+
+func (s *exportSuite) TestWideVariantIDs(c *check.C) {
+	var buffer bytes.Buffer
+	enc, err := newLibraryEncoder(&buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{{Name: "a", Variants: []tileVariantID{1, 70000}}}}), check.IsNil)
+	var output bytes.Buffer
+	exited := (&exportNumpy{}).RunCommand("export-numpy", []string{"-local=true"}, &buffer, &output, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	npy, err := gonpy.NewReader(&output)
+	c.Assert(err, check.IsNil)
+	c.Check(npy.Shape, check.DeepEquals, []int{1, 2})
+	variants, err := npy.GetUint32()
+	c.Assert(err, check.IsNil)
+	c.Check(variants, check.DeepEquals, []uint32{1, 70000})
+}
+
+func (s *exportSuite) TestNpyHeader(c *check.C) {
+	var buf bytes.Buffer
+	npw := &npyWriter{w: &buf, dtype: "<u4", shape: []int{2, 3}}
+	c.Assert(npw.WriteHeader(), check.IsNil)
+	c.Check(buf.Len()%64, check.Equals, 0)
+	c.Check(buf.Bytes()[buf.Len()-1], check.Equals, byte('\n'))
+	c.Assert(binary.Write(&buf, binary.LittleEndian, []uint32{1, 2, 3, 4, 5, 70000}), check.IsNil)
+	npy, err := gonpy.NewReader(&buf)
+	c.Assert(err, check.IsNil)
+	c.Check(npy.Shape, check.DeepEquals, []int{2, 3})
+	data, err := npy.GetUint32()
+	c.Assert(err, check.IsNil)
+	c.Check(data, check.DeepEquals, []uint32{1, 2, 3, 4, 5, 70000})
+}
@@ -2,12 +2,10 @@ package main
 
 import (
 	"bufio"
-	"encoding/gob"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -62,7 +60,7 @@ func (cmd *filterer) RunCommand(prog string, args []string, stdin io.Reader, std
 			Name:        "lightning filter",
 			Client:      arvados.NewClientFromEnv(),
 			ProjectUUID: *projectUUID,
-			RAM:         64000000000,
+			RAM:         16000000000,
 			VCPUs:       2,
 			Priority:    *priority,
 		}
@@ -86,81 +84,56 @@ func (cmd *filterer) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 0
 	}
 
-	var infile io.ReadCloser
-	if *inputFilename == "-" {
-		infile = ioutil.NopCloser(stdin)
-	} else {
-		infile, err = os.Open(*inputFilename)
-		if err != nil {
-			return 1
-		}
-		defer infile.Close()
-	}
-	log.Print("reading")
-	cgs, err := ReadCompactGenomes(infile)
+	infile, cleanup, err := spoolInput(*inputFilename, stdin)
 	if err != nil {
 		return 1
 	}
-	err = infile.Close()
-	if err != nil {
-		return 1
-	}
-	log.Printf("reading done, %d genomes", len(cgs))
+	defer cleanup()
 
-	log.Print("filtering")
-	ntags := 0
-	for _, cg := range cgs {
-		if ntags < len(cg.Variants)/2 {
-			ntags = len(cg.Variants) / 2
-		}
-		if *maxvariants < 0 {
-			continue
-		}
-		maxVariantID := tileVariantID(*maxvariants)
-		for idx, variant := range cg.Variants {
-			if variant > maxVariantID {
-				for _, cg := range cgs {
-					if len(cg.Variants) > idx {
-						cg.Variants[idx & ^1] = 0
-						cg.Variants[idx|1] = 0
-					}
+	// First pass: find the highest variant ID and number of
+	// called haplotypes for each tag.
+	log.Print("reading")
+	var maxVariant []tileVariantID
+	var coverage []int
+	genomes := 0
+	err = decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+		for _, cg := range ent.CompactGenomes {
+			genomes++
+			if ntags := (len(cg.Variants) + 1) / 2; len(coverage) < ntags {
+				maxVariant = append(maxVariant, make([]tileVariantID, ntags-len(maxVariant))...)
+				coverage = append(coverage, make([]int, ntags-len(coverage))...)
+			}
+			for idx, variant := range cg.Variants {
+				if variant > 0 {
+					coverage[idx>>1]++
+				}
+				if maxVariant[idx>>1] < variant {
+					maxVariant[idx>>1] = variant
 				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return 1
 	}
+	log.Printf("reading done, %d genomes", genomes)
 
+	ntags := len(coverage)
 	if *maxtag >= 0 && ntags > *maxtag {
 		ntags = *maxtag
-		for i, cg := range cgs {
-			if len(cg.Variants) > *maxtag*2 {
-				cgs[i].Variants = cg.Variants[:*maxtag*2]
-			}
-		}
 	}
-
-	if *mincoverage < 1 {
-		mincov := int(*mincoverage * float64(len(cgs)*2))
-		cov := make([]int, ntags)
-		for _, cg := range cgs {
-			for idx, variant := range cg.Variants {
-				if variant > 0 {
-					cov[idx>>1]++
-				}
-			}
-		}
-		for tag, c := range cov {
-			if c < mincov {
-				for _, cg := range cgs {
-					if len(cg.Variants) > tag*2 {
-						cg.Variants[tag*2] = 0
-						cg.Variants[tag*2+1] = 0
-					}
-				}
-			}
+	drop := make([]bool, ntags)
+	mincov := int(*mincoverage * float64(genomes*2))
+	dropped := 0
+	for tag := range drop {
+		drop[tag] = (*maxvariants >= 0 && int(maxVariant[tag]) > *maxvariants) ||
+			(*mincoverage < 1 && coverage[tag] < mincov)
+		if drop[tag] {
+			dropped++
 		}
 	}
-
-	log.Print("filtering done")
+	log.Printf("dropping %d of %d tags", dropped+len(coverage)-ntags, len(coverage))
 
 	var outfile io.WriteCloser
 	if *outputFilename == "-" {
@@ -173,15 +146,64 @@ func (cmd *filterer) RunCommand(prog string, args []string, stdin io.Reader, std
 		defer outfile.Close()
 	}
 	w := bufio.NewWriter(outfile)
-	enc := gob.NewEncoder(w)
-	log.Print("writing")
-	err = enc.Encode(LibraryEntry{
-		CompactGenomes: cgs,
+	enc, err := newLibraryEncoder(w)
+	if err != nil {
+		return 1
+	}
+
+	// Second pass: write the filtered genomes, along with the tag
+	// set, and the tile variants and tag positions for the tags
+	// we're keeping.
+	log.Print("filtering")
+	err = decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+		var tvs []TileVariant
+		for _, tv := range ent.TileVariants {
+			if int(tv.Tag) < ntags && !drop[tv.Tag] {
+				tvs = append(tvs, tv)
+			}
+		}
+		ent.TileVariants = tvs
+		var tps []tagPosition
+		for _, tp := range ent.TagPositions {
+			if int(tp.Tag) < ntags && !drop[tp.Tag] {
+				tps = append(tps, tp)
+			}
+		}
+		ent.TagPositions = tps
+		for i, cg := range ent.CompactGenomes {
+			if len(cg.Variants) > ntags*2 {
+				cg.Variants = cg.Variants[:ntags*2]
+				ent.CompactGenomes[i].Variants = cg.Variants
+			}
+			for idx := range cg.Variants {
+				if drop[idx>>1] {
+					cg.Variants[idx] = 0
+				}
+			}
+			var spans []TileSpan
+			for _, span := range cg.Spans {
+				if span.Index < len(cg.Variants) && !drop[span.Index>>1] {
+					spans = append(spans, span)
+				}
+			}
+			ent.CompactGenomes[i].Spans = spans
+			var unphased []tagID
+			for _, tag := range cg.UnphasedTags {
+				if int(tag) < ntags && !drop[tag] {
+					unphased = append(unphased, tag)
+				}
+			}
+			ent.CompactGenomes[i].UnphasedTags = unphased
+		}
+		if len(ent.TagSet) == 0 && len(ent.TileVariants) == 0 && len(ent.CompactGenomes) == 0 && len(ent.TagPositions) == 0 {
+			return nil
+		}
+		return enc.Encode(ent)
 	})
 	if err != nil {
 		return 1
 	}
-	log.Print("writing done")
+	log.Print("filtering done")
 	err = w.Flush()
 	if err != nil {
 		return 1
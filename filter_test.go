@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type filterSuite struct{}
+
+var _ = check.Suite(&filterSuite{})
+
+func (s *filterSuite) TestFilter(c *check.C) {
+	var imported bytes.Buffer
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "testdata/a.1.fasta"}, &bytes.Buffer{}, &imported, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var filtered bytes.Buffer
+	exited = (&filterer{}).RunCommand("filter", []string{"-local=true", "-max-variants=1", "-max-tag=8"}, bytes.NewReader(imported.Bytes()), &filtered, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var tagset [][]byte
+	var cgs []CompactGenome
+	tvs := map[tagID]int{}
+	err := DecodeLibrary(&filtered, func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			tagset = ent.TagSet
+		}
+		for _, tv := range ent.TileVariants {
+			tvs[tv.Tag]++
+		}
+		cgs = append(cgs, ent.CompactGenomes...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(tagset, check.HasLen, 9)
+	c.Assert(cgs, check.HasLen, 1)
+	// Tags 0 and 1 have two variants (the haplotypes differ),
+	// tags 5 and 6 are no-calls, and tag 8 is beyond -max-tag.
+	c.Check(cgs[0].Variants, check.DeepEquals, []tileVariantID{0, 0, 0, 0, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 1, 1})
+	c.Check(tvs, check.DeepEquals, map[tagID]int{2: 1, 3: 1, 4: 1, 7: 1})
+}
@@ -1,39 +1,368 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	_ "net/http/pprof"
+	"os"
+	"sort"
 
+	"git.arvados.org/arvados.git/lib/cmd"
+	"github.com/arvados/lightning/tiling"
 	"golang.org/x/crypto/blake2b"
 )
 
+type (
+	tagID         = tiling.TagID
+	tileVariantID = tiling.TileVariantID
+	tagPosition   = tiling.TagPosition
+)
+
 type CompactGenome struct {
 	Name     string
 	Variants []tileVariantID
+
+	// Spans lists the tiles in Variants that span more than one
+	// tag, because the following tags were skipped or missing.
+	// All other tiles span one tag.
+	Spans []TileSpan
+
+	// UnphasedTags lists, in ascending order, the tags whose
+	// pair of tiles (Variants[tag*2] and Variants[tag*2+1]) is
+	// not phased: the two tiles could belong to the haplotypes in
+	// either order. This happens when a genome imported from a
+	// VCF file has an unphased heterozygous genotype ("0/1") in
+	// the tile. All other pairs are phased.
+	UnphasedTags []tagID
+}
+
+// canonicalPhase reorders each unphased pair of tiles (see
+// UnphasedTags) so the lower variant ID comes first, making the
+// result independent of the order in which the alleles of unphased
+// genotypes were listed.
+//
+// A tile that spans several tags (see Spans) is swapped together
+// with the tiles of the other haplotype for the tags it covers, as
+// one unit, so each haplotype still has exactly one tile for each
+// tag. Such a unit is only swapped if all of its tags are unphased,
+// and its haplotypes are compared tag by tag.
+func (cg *CompactGenome) canonicalPhase() {
+	if len(cg.UnphasedTags) == 0 {
+		return
+	}
+	ntags := len(cg.Variants) / 2
+	unphased := make(map[int]bool, len(cg.UnphasedTags))
+	for _, tag := range cg.UnphasedTags {
+		unphased[int(tag)] = true
+	}
+	// coverEnd[tag] is the tag after the last one covered by a
+	// spanning tile for tag, if there is one.
+	coverEnd := map[int]int{}
+	for _, span := range cg.Spans {
+		tag := span.Index / 2
+		if end := tag + span.Span; end > coverEnd[tag] {
+			coverEnd[tag] = end
+		}
+	}
+	swapped := map[int]bool{}
+	for start := 0; start < ntags; {
+		// Find the end of the unit of tags starting at
+		// start, i.e., the first tag that is not covered by
+		// a spanning tile from an earlier tag.
+		end := start + 1
+		canSwap := true
+		for tag := start; tag < end; tag++ {
+			if coverEnd[tag] > end {
+				end = coverEnd[tag]
+				if end > ntags {
+					end = ntags
+				}
+			}
+			canSwap = canSwap && unphased[tag]
+		}
+		swap := false
+		for tag := start; canSwap && tag < end; tag++ {
+			if v0, v1 := cg.Variants[tag*2], cg.Variants[tag*2+1]; v0 != v1 {
+				swap = v0 > v1
+				break
+			}
+		}
+		for tag := start; swap && tag < end; tag++ {
+			cg.Variants[tag*2], cg.Variants[tag*2+1] = cg.Variants[tag*2+1], cg.Variants[tag*2]
+			swapped[tag] = true
+		}
+		start = end
+	}
+	if len(swapped) == 0 {
+		return
+	}
+	for i, span := range cg.Spans {
+		if swapped[span.Index/2] {
+			cg.Spans[i].Index ^= 1
+		}
+	}
+	sort.Slice(cg.Spans, func(i, j int) bool { return cg.Spans[i].Index < cg.Spans[j].Index })
+}
+
+// TileSpan indicates that the tile at Variants[Index] in a
+// CompactGenome spans Span tags, i.e., the tile for tag Index/2 ends
+// with tag Index/2+Span.
+type TileSpan struct {
+	Index int
+	Span  int
+}
+
+type TileVariant struct {
+	Tag      tagID
+	Variant  tileVariantID
+	Blake2b  [blake2b.Size256]byte
+	Sequence []byte
+
+	// NoCalls lists the positions in Sequence that are not called,
+	// if this is a partial tile (see import -partial-tiles).
+	NoCalls []tiling.NoCallRange
 }
 
 type LibraryEntry struct {
 	TagSet         [][]byte
 	CompactGenomes []CompactGenome
-	TileVariants   []struct {
-		Tag      tagID
-		Blake2b  [blake2b.Size]byte
-		Sequence []byte
+	TileVariants   []TileVariant
+
+	// TagPositions gives the locations of tags on the reference
+	// genome (see import -ref). Tags that were not found, or
+	// were found more than once, are not listed.
+	TagPositions []tagPosition
+}
+
+// A library gob stream starts with libraryMagic, followed by a
+// gob-encoded LibraryHeader and any number of gob-encoded
+// LibraryEntry values (all encoded by the same gob.Encoder).
+//
+// Streams written by older versions of lightning have no magic or
+// header ("version 0"). They can be converted with upgrade-library.
+var libraryMagic = []byte("lightning library\n")
+
+// libraryFormatVersion must be incremented whenever a change to
+// LibraryEntry (or the types it contains) would cause existing
+// libraries to be misinterpreted, and upgradeEntry must be taught
+// to convert entries from the previous version.
+//
+// Version 2 added TileVariant.NoCalls (partial tiles). Version 3
+// added CompactGenome.Spans. Version 4 added
+// CompactGenome.UnphasedTags.
+const libraryFormatVersion = 4
+
+type LibraryHeader struct {
+	FormatVersion    int
+	LightningVersion string
+	CommandLine      []string
+}
+
+// encodeNewTileVariants returns a function, suitable for use as
+// tiling.TileLibrary.NewVariant, that writes each new tile variant to
+// enc as a LibraryEntry with a single TileVariant.
+func encodeNewTileVariants(enc *gob.Encoder) func(tagID, tileVariantID, [blake2b.Size256]byte, []byte) error {
+	return func(tag tagID, variant tileVariantID, hash [blake2b.Size256]byte, seq []byte) error {
+		return enc.Encode(LibraryEntry{
+			TileVariants: []TileVariant{{
+				Tag:      tag,
+				Variant:  variant,
+				Blake2b:  hash,
+				Sequence: seq,
+				NoCalls:  tiling.NoCalls(seq),
+			}},
+		})
 	}
 }
 
-func ReadCompactGenomes(rdr io.Reader) ([]CompactGenome, error) {
+// newLibraryEncoder writes the magic and a header for a new library
+// stream to w, and returns an encoder for the entries that follow.
+func newLibraryEncoder(w io.Writer) (*gob.Encoder, error) {
+	_, err := w.Write(libraryMagic)
+	if err != nil {
+		return nil, err
+	}
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(LibraryHeader{
+		FormatVersion:    libraryFormatVersion,
+		LightningVersion: cmd.Version.String(),
+		CommandLine:      os.Args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// decodeLibraryHeader reads the magic and header from a library
+// stream, and returns a decoder for the entries that follow. An error
+// is returned if the stream has no header or the format version is
+// not supported.
+func decodeLibraryHeader(rdr io.Reader) (*gob.Decoder, *LibraryHeader, error) {
+	dec, hdr, err := decodeLibraryHeaderAnyVersion(rdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.FormatVersion < libraryFormatVersion {
+		return nil, nil, fmt.Errorf("library format version %d (written by lightning %s) is too old, expected version %d (see \"lightning upgrade-library\")", hdr.FormatVersion, hdr.LightningVersion, libraryFormatVersion)
+	} else if hdr.FormatVersion != libraryFormatVersion {
+		return nil, nil, fmt.Errorf("unsupported library format version %d (written by lightning %s), expected version %d", hdr.FormatVersion, hdr.LightningVersion, libraryFormatVersion)
+	}
+	return dec, hdr, nil
+}
+
+// decodeLibraryHeaderAnyVersion is like decodeLibraryHeader, but
+// does not check the format version.
+func decodeLibraryHeaderAnyVersion(rdr io.Reader) (*gob.Decoder, *LibraryHeader, error) {
+	magic := make([]byte, len(libraryMagic))
+	_, err := io.ReadFull(rdr, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !bytes.Equal(magic, libraryMagic)) {
+		return nil, nil, errors.New("input is not a lightning library, or was written by an old version of lightning without a format header (see \"lightning upgrade-library\")")
+	} else if err != nil {
+		return nil, nil, err
+	}
 	dec := gob.NewDecoder(rdr)
-	var ret []CompactGenome
+	var hdr LibraryHeader
+	err = dec.Decode(&hdr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding library header: %s", err)
+	}
+	return dec, &hdr, nil
+}
+
+// DecodeLibrary calls cb once for each LibraryEntry in the given
+// stream, in order, stopping at the first error.
+//
+// An error is returned if the stream has an unsupported format
+// version, contains more than one tag set and they are not identical,
+// or a genome has more tiles than the tag set has tags.
+func DecodeLibrary(rdr io.Reader, cb func(*LibraryEntry) error) error {
+	dec, _, err := decodeLibraryHeader(rdr)
+	if err != nil {
+		return err
+	}
+	return decodeLibraryEntries(dec, cb)
+}
+
+func decodeLibraryEntries(dec *gob.Decoder, cb func(*LibraryEntry) error) error {
+	var tagset [][]byte
 	for {
 		var ent LibraryEntry
 		err := dec.Decode(&ent)
 		if err == io.EOF {
-			return ret, nil
+			return nil
 		} else if err != nil {
-			return nil, err
+			return err
+		}
+		err = checkTagSet(&tagset, ent.TagSet)
+		if err != nil {
+			return err
+		}
+		if tagset != nil {
+			for _, cg := range ent.CompactGenomes {
+				if len(cg.Variants) > len(tagset)*2 {
+					return fmt.Errorf("genome %q has %d tiles per haplotype, but tag set only has %d tags", cg.Name, len(cg.Variants)/2, len(tagset))
+				}
+			}
+		}
+		err = cb(&ent)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadCompactGenomes returns all of the compact genomes in a library
+// stream, along with the tag set they refer to (nil if the stream
+// does not include a tag set).
+func ReadCompactGenomes(rdr io.Reader) ([]CompactGenome, [][]byte, error) {
+	var ret []CompactGenome
+	var tagset [][]byte
+	err := DecodeLibrary(rdr, func(ent *LibraryEntry) error {
+		if len(ent.TagSet) > 0 {
+			tagset = ent.TagSet
 		}
 		ret = append(ret, ent.CompactGenomes...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ret, tagset, nil
+}
+
+// spoolInput returns the name of a file that can be opened (possibly
+// more than once) to read the given input file, or stdin if infile is
+// "-". The caller must call cleanup when finished with the file.
+func spoolInput(infile string, stdin io.Reader) (filename string, cleanup func(), err error) {
+	if infile != "-" {
+		return infile, func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "lightning-stdin-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+	defer f.Close()
+	_, err = io.Copy(f, stdin)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+// decodeLibraryFile is like DecodeLibrary, but reads from the named
+// file.
+func decodeLibraryFile(filename string, cb func(*LibraryEntry) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = DecodeLibrary(bufio.NewReader(f), cb)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkTagSet saves tagset in *known if *known is empty. If both are
+// non-empty and they are not identical, it returns an error.
+func checkTagSet(known *[][]byte, tagset [][]byte) error {
+	if len(tagset) == 0 {
+		return nil
+	} else if len(*known) == 0 {
+		*known = tagset
+		return nil
+	}
+	same := len(*known) == len(tagset)
+	for i := 0; same && i < len(tagset); i++ {
+		same = bytes.EqualFold((*known)[i], tagset[i])
+	}
+	if !same {
+		return fmt.Errorf("tag set mismatch: cannot combine libraries built with different tag sets (%d tags, digest %x vs. %d tags, digest %x)", len(*known), tagSetDigest(*known), len(tagset), tagSetDigest(tagset))
+	}
+	return nil
+}
+
+// tagSetDigest returns a hash of the given tag sequences, suitable
+// for identifying a tag set in log/error messages.
+func tagSetDigest(tagset [][]byte) [blake2b.Size256]byte {
+	h, _ := blake2b.New256(nil)
+	for _, tag := range tagset {
+		h.Write(bytes.ToLower(tag))
+		h.Write([]byte{'\n'})
 	}
+	var sum [blake2b.Size256]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
 }
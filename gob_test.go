@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+
+	"github.com/arvados/lightning/tiling"
+	"gopkg.in/check.v1"
+)
+
+type gobSuite struct{}
+
+var _ = check.Suite(&gobSuite{})
+
+func (s *gobSuite) TestTagSetMismatch(c *check.C) {
+	var buf bytes.Buffer
+	enc, err := newLibraryEncoder(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{TagSet: [][]byte{[]byte("acgt"), []byte("ggcc")}}), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{{Name: "a", Variants: []tileVariantID{1, 1, 1, 2}}}}), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{TagSet: [][]byte{[]byte("ACGT"), []byte("GGCC")}}), check.IsNil)
+	cgs, tagset, err := ReadCompactGenomes(bytes.NewReader(buf.Bytes()))
+	c.Check(err, check.IsNil)
+	c.Check(cgs, check.HasLen, 1)
+	c.Check(tagset, check.HasLen, 2)
+
+	c.Assert(enc.Encode(LibraryEntry{TagSet: [][]byte{[]byte("acgt"), []byte("ttaa")}}), check.IsNil)
+	_, _, err = ReadCompactGenomes(bytes.NewReader(buf.Bytes()))
+	c.Check(err, check.ErrorMatches, `tag set mismatch: .*`)
+}
+
+func (s *gobSuite) TestTooManyTiles(c *check.C) {
+	var buf bytes.Buffer
+	enc, err := newLibraryEncoder(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{TagSet: [][]byte{[]byte("acgt")}}), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{{Name: "a", Variants: []tileVariantID{1, 1, 1, 2}}}}), check.IsNil)
+	_, _, err = ReadCompactGenomes(&buf)
+	c.Check(err, check.ErrorMatches, `genome "a" has 2 tiles per haplotype, but tag set only has 1 tags`)
+}
+
+func (s *gobSuite) TestFormatVersion(c *check.C) {
+	entry := LibraryEntry{TagSet: [][]byte{[]byte("acgt")}, CompactGenomes: []CompactGenome{{Name: "a", Variants: []tileVariantID{1, 2}}}}
+
+	// version 0: no header
+	var buf bytes.Buffer
+	c.Assert(gob.NewEncoder(&buf).Encode(entry), check.IsNil)
+	legacy := buf.Bytes()
+	_, _, err := ReadCompactGenomes(bytes.NewReader(legacy))
+	c.Check(err, check.ErrorMatches, `.*upgrade-library.*`)
+
+	// upgrade-library converts to current version
+	var upgraded bytes.Buffer
+	exited := (&upgradeLibrary{}).RunCommand("upgrade-library", []string{"-local=true"}, bytes.NewReader(legacy), &upgraded, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs, tagset, err := ReadCompactGenomes(bytes.NewReader(upgraded.Bytes()))
+	c.Check(err, check.IsNil)
+	c.Check(tagset, check.DeepEquals, entry.TagSet)
+	c.Check(cgs, check.DeepEquals, entry.CompactGenomes)
+
+	// upgrading a current-version library is a no-op
+	var again bytes.Buffer
+	exited = (&upgradeLibrary{}).RunCommand("upgrade-library", []string{"-local=true"}, bytes.NewReader(upgraded.Bytes()), &again, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs, _, err = ReadCompactGenomes(&again)
+	c.Check(err, check.IsNil)
+	c.Check(cgs, check.DeepEquals, entry.CompactGenomes)
+
+	// version 1: tile variants have no NoCalls
+	buf.Reset()
+	buf.Write(libraryMagic)
+	enc := gob.NewEncoder(&buf)
+	c.Assert(enc.Encode(LibraryHeader{FormatVersion: 1, LightningVersion: "old"}), check.IsNil)
+	c.Assert(enc.Encode(entry), check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{TileVariants: []TileVariant{{Tag: 0, Variant: 1, Sequence: []byte("acgtnnacgt")}}}), check.IsNil)
+	_, _, err = ReadCompactGenomes(bytes.NewReader(buf.Bytes()))
+	c.Check(err, check.ErrorMatches, `library format version 1 \(written by lightning old\) is too old.*upgrade-library.*`)
+	upgraded.Reset()
+	exited = (&upgradeLibrary{}).RunCommand("upgrade-library", []string{"-local=true"}, bytes.NewReader(buf.Bytes()), &upgraded, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	var tvs []TileVariant
+	err = DecodeLibrary(&upgraded, func(ent *LibraryEntry) error {
+		tvs = append(tvs, ent.TileVariants...)
+		return nil
+	})
+	c.Check(err, check.IsNil)
+	c.Assert(tvs, check.HasLen, 1)
+	c.Check(tvs[0].NoCalls, check.DeepEquals, []tiling.NoCallRange{{Start: 4, End: 6}})
+
+	// unknown version
+	buf.Reset()
+	buf.Write(libraryMagic)
+	enc = gob.NewEncoder(&buf)
+	c.Assert(enc.Encode(LibraryHeader{FormatVersion: libraryFormatVersion + 1, LightningVersion: "future"}), check.IsNil)
+	c.Assert(enc.Encode(entry), check.IsNil)
+	_, _, err = ReadCompactGenomes(&buf)
+	c.Check(err, check.ErrorMatches, `unsupported library format version .* \(written by lightning future\).*`)
+}
+
+func (s *gobSuite) TestUint16VariantIDs(c *check.C) {
+	// Libraries written when tileVariantID was uint16 can still
+	// be decoded.
+	type oldCompactGenome struct {
+		Name     string
+		Variants []uint16
+	}
+	type oldLibraryEntry struct {
+		CompactGenomes []oldCompactGenome
+	}
+	var buf bytes.Buffer
+	buf.Write(libraryMagic)
+	enc := gob.NewEncoder(&buf)
+	c.Assert(enc.Encode(LibraryHeader{FormatVersion: libraryFormatVersion}), check.IsNil)
+	c.Assert(enc.Encode(oldLibraryEntry{CompactGenomes: []oldCompactGenome{{Name: "a", Variants: []uint16{1, 65535}}}}), check.IsNil)
+	cgs, _, err := ReadCompactGenomes(&buf)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.DeepEquals, []CompactGenome{{Name: "a", Variants: []tileVariantID{1, 65535}}})
+}
+
+func (s *gobSuite) TestCanonicalPhase(c *check.C) {
+	cg := CompactGenome{
+		Variants: []tileVariantID{
+			2, 1, // phased
+			1, 3, // unphased, hap 1 spans tags 1-2
+			4, 0,
+			5, 2, // unphased, hap 0 spans tags 3-4
+			0, 6,
+			7, 1, // unphased
+			9, 8, // unphased, hap 0 spans tags 6-7
+			0, 7, // phased
+		},
+		Spans:        []TileSpan{{Index: 3, Span: 2}, {Index: 6, Span: 2}, {Index: 12, Span: 2}},
+		UnphasedTags: []tagID{1, 2, 3, 4, 5, 6},
+	}
+	cg.canonicalPhase()
+	c.Check(cg.Variants, check.DeepEquals, []tileVariantID{
+		2, 1,
+		1, 3, // not swapped: 1 < 3, even though 4 > 0
+		4, 0,
+		2, 5, // swapped with tag 4, as a unit
+		6, 0,
+		1, 7,
+		9, 8, // not swapped: the span covers a phased tag
+		0, 7,
+	})
+	c.Check(cg.Spans, check.DeepEquals, []TileSpan{{Index: 3, Span: 2}, {Index: 7, Span: 2}, {Index: 12, Span: 2}})
+	// Each tag covered by a spanning tile has no tile of its own
+	// in the same haplotype.
+	for _, span := range cg.Spans {
+		for i := 1; i < span.Span; i++ {
+			c.Check(cg.Variants[span.Index+i*2], check.Equals, tileVariantID(0), check.Commentf("span %+v", span))
+		}
+	}
+}
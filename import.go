@@ -11,7 +11,6 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -22,17 +21,26 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/tiling"
 	log "github.com/sirupsen/logrus"
 )
 
 type importer struct {
 	tagLibraryFile string
 	refFile        string
+	appendFile     string
 	outputFile     string
 	projectUUID    string
 	runLocal       bool
 	skipOOO        bool
+	partialTiles   bool
+	include        string
+	exclude        string
 	encoder        *gob.Encoder
+
+	// tagPositions[chrom] lists the positions of the unique tags
+	// on the given reference sequence, sorted by start position
+	tagPositions map[string][]tagPosition
 }
 
 func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
@@ -45,11 +53,15 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	flags := flag.NewFlagSet("", flag.ContinueOnError)
 	flags.SetOutput(stderr)
 	flags.StringVar(&cmd.tagLibraryFile, "tag-library", "", "tag library fasta `file`")
-	flags.StringVar(&cmd.refFile, "ref", "", "reference fasta `file`")
+	flags.StringVar(&cmd.refFile, "ref", "", "reference fasta `file` (used to record tag positions, and to import vcf inputs)")
+	flags.StringVar(&cmd.appendFile, "append", "", "existing library `file` to extend with the new inputs")
 	flags.StringVar(&cmd.outputFile, "o", "-", "output `file`")
 	flags.StringVar(&cmd.projectUUID, "project", "", "project `UUID` for output data")
 	flags.BoolVar(&cmd.runLocal, "local", false, "run on local host (default: run in an arvados container)")
 	flags.BoolVar(&cmd.skipOOO, "skip-ooo", false, "skip out-of-order tags")
+	flags.StringVar(&cmd.include, "include", "", "tile only sequences whose labels match `regexp`, e.g., \"^chr([0-9]+|X|Y)$\" (default: all)")
+	flags.StringVar(&cmd.exclude, "exclude", tiling.DefaultExclude.String(), "skip sequences whose labels match `regexp` (empty: none)")
+	flags.BoolVar(&cmd.partialTiles, "partial-tiles", false, "keep tiles with some no-calls as partial tile variants (default: treat them as missing)")
 	priority := flags.Int("priority", 500, "container request priority")
 	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
 	loglevel := flags.String("loglevel", "info", "logging threshold (trace, debug, info, warn, error, fatal, or panic)")
@@ -65,6 +77,14 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	} else if flags.NArg() == 0 {
 		flags.Usage()
 		return 2
+	} else if cmd.appendFile != "" && cmd.appendFile == cmd.outputFile {
+		err = errors.New("cannot append to a library in place: output file must be different from -append file")
+		return 2
+	}
+	for _, re := range []string{cmd.include, cmd.exclude} {
+		if _, err = regexp.Compile(re); err != nil {
+			return 2
+		}
 	}
 
 	if *pprof != "" {
@@ -88,7 +108,7 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 			VCPUs:       16,
 			Priority:    *priority,
 		}
-		err = runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.refFile, &cmd.outputFile)
+		err = runner.TranslatePaths(&cmd.tagLibraryFile, &cmd.refFile, &cmd.appendFile, &cmd.outputFile)
 		if err != nil {
 			return 1
 		}
@@ -108,7 +128,7 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 			err = errors.New("cannot specify output file in container mode: not implemented")
 			return 1
 		}
-		runner.Args = append([]string{"import", "-local=true", "-loglevel=" + *loglevel, fmt.Sprintf("-skip-ooo=%v", cmd.skipOOO), "-tag-library", cmd.tagLibraryFile, "-ref", cmd.refFile, "-o", cmd.outputFile}, inputs...)
+		runner.Args = append([]string{"import", "-local=true", "-loglevel=" + *loglevel, fmt.Sprintf("-skip-ooo=%v", cmd.skipOOO), fmt.Sprintf("-partial-tiles=%v", cmd.partialTiles), "-include=" + cmd.include, "-exclude=" + cmd.exclude, "-tag-library", cmd.tagLibraryFile, "-ref", cmd.refFile, "-append", cmd.appendFile, "-o", cmd.outputFile}, inputs...)
 		var output string
 		output, err = runner.Run()
 		if err != nil {
@@ -123,13 +143,18 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 		return 1
 	}
 
-	tilelib, err := cmd.loadTileLibrary()
+	tiler, err := cmd.loadTiler()
+	if err != nil {
+		return 1
+	}
+	nworkers := runtime.NumCPU()*9/8 + 1
+	jobs, genomes, err := cmd.inputJobs(tiler, infiles, nworkers)
 	if err != nil {
 		return 1
 	}
 	go func() {
 		for range time.Tick(10 * time.Minute) {
-			log.Printf("tilelib.Len() == %d", tilelib.Len())
+			log.Printf("tile library has %d variants", tiler.TileLibrary.Len())
 		}
 	}()
 
@@ -144,9 +169,29 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 		defer output.Close()
 	}
 	bufw := bufio.NewWriter(output)
-	cmd.encoder = gob.NewEncoder(bufw)
+	cmd.encoder, err = newLibraryEncoder(bufw)
+	if err != nil {
+		return 1
+	}
+	tiler.TileLibrary.NewVariant = encodeNewTileVariants(cmd.encoder)
+	err = cmd.encoder.Encode(LibraryEntry{TagSet: tiler.TagLibrary.Tags()})
+	if err != nil {
+		return 1
+	}
+	if cmd.refFile != "" {
+		err = cmd.locateTags(tiler)
+		if err != nil {
+			return 1
+		}
+	}
+	if cmd.appendFile != "" {
+		err = cmd.appendLibrary(tiler, genomes)
+		if err != nil {
+			return 1
+		}
+	}
 
-	err = cmd.tileInputs(tilelib, infiles)
+	err = runJobs(nworkers, jobs)
 	if err != nil {
 		return 1
 	}
@@ -161,7 +206,7 @@ func (cmd *importer) RunCommand(prog string, args []string, stdin io.Reader, std
 	return 0
 }
 
-func (cmd *importer) tileFasta(tilelib *tileLibrary, infile string) (tileSeq, error) {
+func (cmd *importer) tileFasta(tiler *tiling.Tiler, infile string) (tiling.TileSeq, error) {
 	var input io.ReadCloser
 	input, err := os.Open(infile)
 	if err != nil {
@@ -175,25 +220,45 @@ func (cmd *importer) tileFasta(tilelib *tileLibrary, infile string) (tileSeq, er
 		}
 		defer input.Close()
 	}
-	return tilelib.TileFasta(infile, input)
+	return tiler.TileFasta(infile, input)
+}
+
+func (cmd *importer) loadTiler() (*tiling.Tiler, error) {
+	taglib, err := loadTagLibrary(cmd.tagLibraryFile)
+	if err != nil {
+		return nil, err
+	}
+	tiler := tiling.NewTiler(taglib)
+	tiler.SkipOOO = cmd.skipOOO
+	tiler.TileLibrary.KeepPartial = cmd.partialTiles
+	if cmd.include != "" {
+		tiler.Include = regexp.MustCompile(cmd.include)
+	}
+	tiler.Exclude = nil
+	if cmd.exclude != "" {
+		tiler.Exclude = regexp.MustCompile(cmd.exclude)
+	}
+	return tiler, nil
 }
 
-func (cmd *importer) loadTileLibrary() (*tileLibrary, error) {
-	log.Printf("tag library %s load starting", cmd.tagLibraryFile)
-	f, err := os.Open(cmd.tagLibraryFile)
+// loadTagLibrary loads a tag library from a (possibly gzipped) fasta
+// file.
+func loadTagLibrary(filename string) (*tiling.TagLibrary, error) {
+	log.Printf("tag library %s load starting", filename)
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 	var rdr io.ReadCloser = f
-	if strings.HasSuffix(cmd.tagLibraryFile, ".gz") {
+	if strings.HasSuffix(filename, ".gz") {
 		rdr, err = gzip.NewReader(f)
 		if err != nil {
-			return nil, fmt.Errorf("%s: gzip: %s", cmd.tagLibraryFile, err)
+			return nil, fmt.Errorf("%s: gzip: %s", filename, err)
 		}
 		defer rdr.Close()
 	}
-	var taglib tagLibrary
+	var taglib tiling.TagLibrary
 	err = taglib.Load(rdr)
 	if err != nil {
 		return nil, err
@@ -201,8 +266,104 @@ func (cmd *importer) loadTileLibrary() (*tileLibrary, error) {
 	if taglib.Len() < 1 {
 		return nil, fmt.Errorf("cannot tile: tag library is empty")
 	}
-	log.Printf("tag library %s load done", cmd.tagLibraryFile)
-	return &tileLibrary{taglib: &taglib, skipOOO: cmd.skipOOO}, nil
+	log.Printf("tag library %s load done", filename)
+	return &taglib, nil
+}
+
+// appendLibrary copies the genomes and tile variants from an existing
+// library (cmd.appendFile) to the output, and seeds tiler with the
+// existing variants so they keep their variant IDs.
+//
+// The existing library must have been built with the same tag
+// library, and must not already include any of the given genomes
+// (genome name => input file, see inputJobs).
+func (cmd *importer) appendLibrary(tiler *tiling.Tiler, newGenomes map[string]string) error {
+	log.Printf("%s: copying existing library", cmd.appendFile)
+	tagset := tiler.TagLibrary.Tags()
+	genomes := 0
+	err := decodeLibraryFile(cmd.appendFile, func(ent *LibraryEntry) error {
+		err := checkTagSet(&tagset, ent.TagSet)
+		if err != nil {
+			return err
+		}
+		for _, tv := range ent.TileVariants {
+			err = tiler.TileLibrary.AddKnownVariant(tv.Tag, tv.Variant, tv.Blake2b)
+			if err != nil {
+				return err
+			}
+		}
+		for _, cg := range ent.CompactGenomes {
+			if infile, ok := newGenomes[cg.Name]; ok {
+				return fmt.Errorf("genome %q (from %s) is already in the library", cg.Name, infile)
+			}
+		}
+		genomes += len(ent.CompactGenomes)
+		if cmd.refFile != "" {
+			// replaced by the positions from locateTags
+			ent.TagPositions = nil
+		}
+		if len(ent.TileVariants) == 0 && len(ent.CompactGenomes) == 0 && len(ent.TagPositions) == 0 {
+			return nil
+		}
+		return cmd.encoder.Encode(LibraryEntry{
+			CompactGenomes: ent.CompactGenomes,
+			TileVariants:   ent.TileVariants,
+			TagPositions:   ent.TagPositions,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", cmd.appendFile, err)
+	}
+	log.Printf("%s: copied %d genomes and %d tile variants", cmd.appendFile, genomes, tiler.TileLibrary.Len())
+	return nil
+}
+
+// locateTags finds the positions of the tags in the reference genome
+// (cmd.refFile) and writes them to the output. Tags that are found
+// more than once are omitted.
+func (cmd *importer) locateTags(tiler *tiling.Tiler) error {
+	var input io.ReadCloser
+	input, err := os.Open(cmd.refFile)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	if strings.HasSuffix(cmd.refFile, ".gz") {
+		input, err = gzip.NewReader(input)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+	tps, err := tiler.LocateFasta(cmd.refFile, input)
+	if err != nil {
+		return err
+	}
+	count := make([]int, tiler.TagLibrary.Len())
+	for _, tp := range tps {
+		count[tp.Tag]++
+	}
+	var unique []tagPosition
+	for _, tp := range tps {
+		if count[tp.Tag] == 1 {
+			unique = append(unique, tp)
+		}
+	}
+	repeated := 0
+	for _, n := range count {
+		if n > 1 {
+			repeated++
+		}
+	}
+	log.Printf("%s: recorded positions of %d tags, omitted %d tags found more than once", cmd.refFile, len(unique), repeated)
+	cmd.tagPositions = map[string][]tagPosition{}
+	for _, tp := range unique {
+		cmd.tagPositions[tp.Chrom] = append(cmd.tagPositions[tp.Chrom], tp)
+	}
+	for _, tps := range cmd.tagPositions {
+		sort.Slice(tps, func(i, j int) bool { return tps[i].Start < tps[j].Start })
+	}
+	return cmd.encoder.Encode(LibraryEntry{TagPositions: unique})
 }
 
 func listInputFiles(paths []string) (files []string, err error) {
@@ -234,174 +395,308 @@ func listInputFiles(paths []string) (files []string, err error) {
 		}
 		d.Close()
 	}
-	for _, file := range files {
-		if strings.HasSuffix(file, ".1.fasta") || strings.HasSuffix(file, ".1.fasta.gz") {
-			continue
-		} else if _, err := os.Stat(file + ".csi"); err == nil {
-			continue
-		} else if _, err = os.Stat(file + ".tbi"); err == nil {
-			continue
-		} else {
-			return nil, fmt.Errorf("%s: cannot read without .tbi or .csi index file", file)
-		}
-	}
 	return
 }
 
-func (cmd *importer) tileInputs(tilelib *tileLibrary, infiles []string) error {
+// A job is a unit of work for runJobs that keeps some number of
+// workers busy, e.g., one for each haplotype it tiles at once.
+type job struct {
+	workers int
+	run     func() error
+}
+
+// runJobs runs the given jobs in order, starting each one as soon as
+// enough of nworkers workers are idle, and logs progress (counted in
+// workers) as they finish. After a job fails, no more jobs are
+// started, and the first error is returned when the running jobs
+// have finished.
+func runJobs(nworkers int, jobs []job) error {
 	starttime := time.Now()
+	total := 0
+	for _, j := range jobs {
+		total += j.workers
+	}
+	busy := make(chan struct{}, nworkers)
 	errs := make(chan error, 1)
-	todo := make(chan func() error, len(infiles)*2)
-	var encodeJobs sync.WaitGroup
-	for _, infile := range infiles {
-		infile := infile
-		var phases sync.WaitGroup
-		phases.Add(2)
-		variants := make([][]tileVariantID, 2)
-		if strings.HasSuffix(infile, ".1.fasta") || strings.HasSuffix(infile, ".1.fasta.gz") {
-			todo <- func() error {
-				defer phases.Done()
-				log.Printf("%s starting", infile)
-				defer log.Printf("%s done", infile)
-				tseqs, err := cmd.tileFasta(tilelib, infile)
-				var kept, dropped int
-				variants[0], kept, dropped = tseqs.Variants()
-				log.Printf("%s found %d unique tags plus %d repeats", infile, kept, dropped)
-				return err
-			}
-			infile2 := regexp.MustCompile(`\.1\.fasta(\.gz)?$`).ReplaceAllString(infile, `.2.fasta$1`)
-			todo <- func() error {
-				defer phases.Done()
-				log.Printf("%s starting", infile2)
-				defer log.Printf("%s done", infile2)
-				tseqs, err := cmd.tileFasta(tilelib, infile2)
-				var kept, dropped int
-				variants[1], kept, dropped = tseqs.Variants()
-				log.Printf("%s found %d unique tags plus %d repeats", infile, kept, dropped)
-				return err
-			}
-		} else {
-			for phase := 0; phase < 2; phase++ {
-				phase := phase
-				todo <- func() error {
-					defer phases.Done()
-					log.Printf("%s phase %d starting", infile, phase+1)
-					defer log.Printf("%s phase %d done", infile, phase+1)
-					tseqs, err := cmd.tileGVCF(tilelib, infile, phase)
-					var kept, dropped int
-					variants[phase], kept, dropped = tseqs.Variants()
-					log.Printf("%s phase %d found %d unique tags plus %d repeats", infile, phase+1, kept, dropped)
-					return err
-				}
-			}
+	var finished int64
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		j := j
+		n := j.workers
+		if n > nworkers {
+			n = nworkers
+		}
+		for i := 0; i < n; i++ {
+			busy <- struct{}{}
+		}
+		if len(errs) > 0 {
+			break
 		}
-		encodeJobs.Add(1)
+		wg.Add(1)
 		go func() {
-			defer encodeJobs.Done()
-			phases.Wait()
-			if len(errs) > 0 {
-				return
-			}
-			ntags := len(variants[0])
-			if ntags < len(variants[1]) {
-				ntags = len(variants[1])
+			defer wg.Done()
+			err := j.run()
+			for i := 0; i < n; i++ {
+				<-busy
 			}
-			flat := make([]tileVariantID, ntags*2)
-			for i := 0; i < ntags; i++ {
-				for hap := 0; hap < 2; hap++ {
-					if i < len(variants[hap]) {
-						flat[i*2+hap] = variants[hap][i]
-					}
-				}
-			}
-			err := cmd.encoder.Encode(LibraryEntry{
-				CompactGenomes: []CompactGenome{{Name: infile, Variants: flat}},
-			})
 			if err != nil {
 				select {
 				case errs <- err:
 				default:
 				}
+				return
 			}
+			done := int(atomic.AddInt64(&finished, int64(j.workers)))
+			ttl := time.Now().Sub(starttime) * time.Duration(total-done) / time.Duration(done)
+			eta := time.Now().Add(ttl)
+			log.Printf("progress %d/%d, eta %v (%v)", done, total, eta, ttl)
 		}()
 	}
-	go close(todo)
-	var tileJobs sync.WaitGroup
-	var running int64
-	for i := 0; i < runtime.NumCPU()*9/8+1; i++ {
-		tileJobs.Add(1)
-		atomic.AddInt64(&running, 1)
-		go func() {
-			defer tileJobs.Done()
-			defer atomic.AddInt64(&running, -1)
-			for fn := range todo {
-				if len(errs) > 0 {
-					return
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// inputJobs opens the input files, and returns the jobs (for
+// runJobs) that tile them and write the resulting genomes to the
+// output, along with the names of those genomes (genome name =>
+// input file). A fasta input produces one genome, named after the
+// input file; a VCF input produces one genome for each sample, named
+// after the sample.
+func (cmd *importer) inputJobs(tiler *tiling.Tiler, infiles []string, nworkers int) ([]job, map[string]string, error) {
+	var jobs []job
+	genomeFile := map[string]string{} // genome name => input file
+	addGenome := func(name, infile string) error {
+		if prev, ok := genomeFile[name]; ok {
+			return fmt.Errorf("duplicate genome name %q (from %s and %s)", name, prev, infile)
+		}
+		genomeFile[name] = infile
+		return nil
+	}
+	// VCF files with the same samples (e.g., one file per
+	// chromosome) are combined into one genome per sample.
+	var vcfGroups [][]*vcfFile
+	vcfGroupIndex := map[string]int{} // sample names => index in vcfGroups
+	for _, infile := range infiles {
+		infile := infile
+		if strings.HasSuffix(infile, ".1.fasta") || strings.HasSuffix(infile, ".1.fasta.gz") {
+			err := addGenome(infile, infile)
+			if err != nil {
+				return nil, nil, err
+			}
+			infile2 := regexp.MustCompile(`\.1\.fasta(\.gz)?$`).ReplaceAllString(infile, `.2.fasta$1`)
+			jobs = append(jobs, job{workers: 2, run: func() error {
+				labels := [2]string{infile, infile2}
+				var tseqs [2]tiling.TileSeq
+				var errs [2]error
+				var wg sync.WaitGroup
+				for hap := range labels {
+					hap := hap
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						log.Printf("%s starting", labels[hap])
+						defer log.Printf("%s done", labels[hap])
+						tseqs[hap], errs[hap] = cmd.tileFasta(tiler, labels[hap])
+					}()
 				}
-				err := fn()
+				wg.Wait()
+				for _, err := range errs {
+					if err != nil {
+						return err
+					}
+				}
+				return cmd.encodeGenome(infile, labels, tseqs, nil)
+			}})
+			continue
+		}
+		if cmd.refFile == "" {
+			return nil, nil, errors.New("cannot import vcf: reference data (-ref) not specified")
+		}
+		vf, err := openVCF(infile)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("%s: %d samples", infile, len(vf.samples))
+		key := strings.Join(vf.samples, "\t")
+		if i, ok := vcfGroupIndex[key]; ok {
+			vcfGroups[i] = append(vcfGroups[i], vf)
+			continue
+		}
+		for _, name := range vf.samples {
+			err = addGenome(name, infile)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		vcfGroupIndex[key] = len(vcfGroups)
+		vcfGroups = append(vcfGroups, []*vcfFile{vf})
+	}
+	for _, vfs := range vcfGroups {
+		vfs := vfs
+		// Tile both haplotypes of up to nworkers/2 samples in
+		// each pass through the VCF files.
+		batch := nworkers / 2
+		if batch < 1 {
+			batch = 1
+		}
+		for start := 0; start < len(vfs[0].samples); start += batch {
+			var samples []int
+			for sample := start; sample < start+batch && sample < len(vfs[0].samples); sample++ {
+				samples = append(samples, sample)
+			}
+			jobs = append(jobs, job{workers: len(samples) * 2, run: func() error {
+				tseqs, unphased, err := cmd.tileVCF(tiler, vfs, samples)
 				if err != nil {
-					select {
-					case errs <- err:
-					default:
+					return err
+				}
+				for i, sample := range samples {
+					name := vfs[0].samples[sample]
+					err = cmd.encodeGenome(name, [2]string{
+						fmt.Sprintf("%s sample %s phase 1", vcfGroupName(vfs), name),
+						fmt.Sprintf("%s sample %s phase 2", vcfGroupName(vfs), name),
+					}, tseqs[i], unphased[i])
+					if err != nil {
+						return err
 					}
 				}
-				remain := len(todo) + int(atomic.LoadInt64(&running)) - 1
-				ttl := time.Now().Sub(starttime) * time.Duration(remain) / time.Duration(cap(todo)-remain)
-				eta := time.Now().Add(ttl)
-				log.Printf("progress %d/%d, eta %v (%v)", cap(todo)-remain, cap(todo), eta, ttl)
+				return nil
+			}})
+		}
+	}
+	return jobs, genomeFile, nil
+}
+
+// encodeGenome writes a genome to the output library, given the tile
+// sequences of its two haplotypes and its unphased tags (see
+// CompactGenome.UnphasedTags).
+func (cmd *importer) encodeGenome(name string, labels [2]string, tseqs [2]tiling.TileSeq, unphased []tagID) error {
+	var variants [2][]tiling.TileLibRef
+	for hap := range tseqs {
+		var kept, dropped int
+		variants[hap], kept, dropped = tseqs[hap].Variants()
+		log.Printf("%s found %d unique tags plus %d repeats", labels[hap], kept, dropped)
+	}
+	ntags := len(variants[0])
+	if ntags < len(variants[1]) {
+		ntags = len(variants[1])
+	}
+	flat := make([]tileVariantID, ntags*2)
+	var spans []TileSpan
+	for i := 0; i < ntags; i++ {
+		for hap := 0; hap < 2; hap++ {
+			if i < len(variants[hap]) {
+				ref := variants[hap][i]
+				flat[i*2+hap] = ref.Variant
+				if ref.Span > 1 {
+					spans = append(spans, TileSpan{Index: i*2 + hap, Span: ref.Span})
+				}
 			}
-		}()
+		}
 	}
-	tileJobs.Wait()
-	encodeJobs.Wait()
-	go close(errs)
-	return <-errs
+	return cmd.encoder.Encode(LibraryEntry{
+		CompactGenomes: []CompactGenome{{Name: name, Variants: flat, Spans: spans, UnphasedTags: unphased}},
+	})
 }
 
-func (cmd *importer) tileGVCF(tilelib *tileLibrary, infile string, phase int) (tileseq tileSeq, err error) {
-	if cmd.refFile == "" {
-		err = errors.New("cannot import vcf: reference data (-ref) not specified")
-		return
-	}
-	args := []string{"bcftools", "consensus", "--fasta-ref", cmd.refFile, "-H", fmt.Sprint(phase + 1), infile}
-	indexsuffix := ".tbi"
-	if _, err := os.Stat(infile + ".csi"); err == nil {
-		indexsuffix = ".csi"
-	}
-	if out, err := exec.Command("docker", "image", "ls", "-q", "lightning-runtime").Output(); err == nil && len(out) > 0 {
-		args = append([]string{
-			"docker", "run", "--rm",
-			"--log-driver=none",
-			"--volume=" + infile + ":" + infile + ":ro",
-			"--volume=" + infile + indexsuffix + ":" + infile + indexsuffix + ":ro",
-			"--volume=" + cmd.refFile + ":" + cmd.refFile + ":ro",
-			"lightning-runtime",
-		}, args...)
-	}
-	consensus := exec.Command(args[0], args[1:]...)
-	consensus.Stderr = os.Stderr
-	stdout, err := consensus.StdoutPipe()
-	defer stdout.Close()
-	if err != nil {
-		return
+// errTilingFailed is used to stop a vcfConsensus writer when the
+// reading end fails.
+var errTilingFailed = errors.New("tiling failed")
+
+// vcfGroupName returns a name for a group of VCF files with the same
+// samples, for use in log and error messages.
+func vcfGroupName(vfs []*vcfFile) string {
+	if len(vfs) == 1 {
+		return vfs[0].filename
 	}
-	err = consensus.Start()
-	if err != nil {
-		return
+	return fmt.Sprintf("%s (and %d other files)", vfs[0].filename, len(vfs)-1)
+}
+
+// tileVCF tiles both haplotypes of the given samples in a group of
+// VCF files with the same samples, in a single pass through the
+// files (see vcfConsensus). It returns the tile sequences of the
+// haplotypes (1 and 2) and the unphased tags of each sample.
+func (cmd *importer) tileVCF(tiler *tiling.Tiler, vfs []*vcfFile, samples []int) ([][2]tiling.TileSeq, [][]tagID, error) {
+	consensus := &vcfConsensus{vcfs: vfs, refFile: cmd.refFile}
+	var labels []string
+	var readers []*io.PipeReader
+	var writers []*io.PipeWriter
+	for _, sample := range samples {
+		for phase := 1; phase <= 2; phase++ {
+			pr, pw := io.Pipe()
+			consensus.haplotypes = append(consensus.haplotypes, &vcfHaplotype{sample: sample, phase: phase, w: pw})
+			labels = append(labels, fmt.Sprintf("%s sample %s phase %d", vcfGroupName(vfs), vfs[0].samples[sample], phase))
+			readers = append(readers, pr)
+			writers = append(writers, pw)
+		}
 	}
-	defer consensus.Wait()
-	tileseq, err = tilelib.TileFasta(fmt.Sprintf("%s phase %d", infile, phase+1), stdout)
-	if err != nil {
-		return
+	consensusErr := make(chan error, 1)
+	go func() {
+		err := consensus.writeFasta()
+		for _, pw := range writers {
+			pw.CloseWithError(err)
+		}
+		consensusErr <- err
+	}()
+	tseqs := make([]tiling.TileSeq, len(readers))
+	errs := make([]error, len(readers))
+	var wg sync.WaitGroup
+	for i := range readers {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Printf("%s starting", labels[i])
+			defer log.Printf("%s done", labels[i])
+			tseqs[i], errs[i] = tiler.TileFasta(labels[i], readers[i])
+			// unblock the writer, in case TileFasta failed
+			// before reading everything
+			readers[i].CloseWithError(errTilingFailed)
+		}()
 	}
-	err = stdout.Close()
-	if err != nil {
-		return
+	wg.Wait()
+	err := <-consensusErr
+	// Report a tiling error in preference to the consensus
+	// errors it causes, and a consensus error in preference to
+	// the tiling errors it causes.
+	for _, tileErr := range errs {
+		if tileErr != nil && tileErr != err && tileErr != errTilingFailed {
+			return nil, nil, tileErr
+		}
 	}
-	err = consensus.Wait()
 	if err != nil {
-		err = fmt.Errorf("%s phase %d: bcftools: %s", infile, phase, err)
-		return
+		return nil, nil, fmt.Errorf("%s: %s", vcfGroupName(vfs), err)
 	}
-	return
+	ret := make([][2]tiling.TileSeq, len(samples))
+	unphased := make([][]tagID, len(samples))
+	for i := range samples {
+		ret[i] = [2]tiling.TileSeq{tseqs[i*2], tseqs[i*2+1]}
+		unphased[i] = cmd.unphasedTags(consensus.haplotypes[i*2].unphased)
+	}
+	return ret, unphased, nil
+}
+
+func (cmd *importer) unphasedTags(regions map[string][]bedRegion) []tagID {
+	found := map[tagID]bool{}
+	for chrom, rs := range regions {
+		tps := cmd.tagPositions[chrom]
+		for _, r := range rs {
+			// The first tile that overlaps r is the one
+			// before the first tag that ends after
+			// r.start.
+			i := sort.Search(len(tps), func(i int) bool { return tps[i].End > r.start })
+			if i > 0 {
+				i--
+			}
+			for ; i < len(tps) && tps[i].Start < r.end; i++ {
+				found[tps[i].Tag] = true
+			}
+		}
+	}
+	var tags []tagID
+	for tag := range found {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/arvados/lightning/tiling"
+	"golang.org/x/crypto/blake2b"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type importSuite struct{}
+
+var _ = check.Suite(&importSuite{})
+
+func (s *importSuite) TestImportTileVariants(c *check.C) {
+	var buffer bytes.Buffer
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", "testdata/ref", "testdata/a.1.fasta"}, &bytes.Buffer{}, &buffer, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	known := map[tiling.TileLibRef]bool{}
+	var cgs []CompactGenome
+	var tps []tagPosition
+	entries := 0
+	err := DecodeLibrary(&buffer, func(ent *LibraryEntry) error {
+		entries++
+		if entries == 1 {
+			c.Check(ent.TagSet, check.HasLen, 9)
+			c.Check(string(ent.TagSet[8]), check.Equals, "atgtttagctcccccttgttaggt")
+		}
+		for _, tv := range ent.TileVariants {
+			c.Check(tv.Blake2b, check.Equals, blake2b.Sum256(tv.Sequence))
+			c.Check(tv.Variant > 0, check.Equals, true)
+			ref := tiling.TileLibRef{Tag: tv.Tag, Variant: tv.Variant}
+			c.Check(known[ref], check.Equals, false, check.Commentf("duplicate %v", ref))
+			known[ref] = true
+		}
+		for _, cg := range ent.CompactGenomes {
+			for tag, variant := range cg.Variants {
+				if variant > 0 {
+					// Every tile variant used by a genome
+					// must appear before the genome itself.
+					c.Check(known[tiling.TileLibRef{Tag: tagID(tag / 2), Variant: variant}], check.Equals, true)
+				}
+			}
+		}
+		cgs = append(cgs, ent.CompactGenomes...)
+		tps = append(tps, ent.TagPositions...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.HasLen, 1)
+	c.Check(len(known) > 0, check.Equals, true)
+	c.Assert(tps, check.HasLen, 9)
+	c.Check(tps[0], check.Equals, tagPosition{Tag: 0, Chrom: "chr1", Start: 0, End: 24})
+	c.Check(tps[8], check.Equals, tagPosition{Tag: 8, Chrom: "chr1", Start: 384, End: 408})
+}
+
+func (s *importSuite) TestImportAppend(c *check.C) {
+	tempdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempdir)
+
+	// b is the same as a, but with haplotypes swapped.
+	for dst, src := range map[string]string{
+		"b.1.fasta": "a.2.fasta",
+		"b.2.fasta": "a.1.fasta",
+	} {
+		buf, err := ioutil.ReadFile("testdata/" + src)
+		c.Assert(err, check.IsNil)
+		err = ioutil.WriteFile(tempdir+"/"+dst, buf, 0644)
+		c.Assert(err, check.IsNil)
+	}
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-o", tempdir + "/a.gob", "testdata/a.1.fasta"}, &bytes.Buffer{}, &bytes.Buffer{}, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	f, err := os.Open(tempdir + "/a.gob")
+	c.Assert(err, check.IsNil)
+	orig, _, err := ReadCompactGenomes(f)
+	f.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(orig, check.HasLen, 1)
+
+	var output bytes.Buffer
+	exited = (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-append", tempdir + "/a.gob", tempdir + "/b.1.fasta"}, &bytes.Buffer{}, &output, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var cgs []CompactGenome
+	tvs := 0
+	err = DecodeLibrary(&output, func(ent *LibraryEntry) error {
+		tvs += len(ent.TileVariants)
+		cgs = append(cgs, ent.CompactGenomes...)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	// b has the same tiles as a, so no tile variants are added.
+	c.Check(tvs, check.Equals, 9)
+	c.Assert(cgs, check.HasLen, 2)
+	c.Check(cgs[0], check.DeepEquals, orig[0])
+	c.Check(cgs[1].Name, check.Equals, tempdir+"/b.1.fasta")
+	c.Assert(cgs[1].Variants, check.HasLen, len(cgs[0].Variants))
+	for i := 0; i < len(cgs[0].Variants); i += 2 {
+		c.Check(cgs[1].Variants[i], check.Equals, cgs[0].Variants[i+1])
+		c.Check(cgs[1].Variants[i+1], check.Equals, cgs[0].Variants[i])
+	}
+
+	// Appending a genome that is already in the library fails.
+	exited = (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-append", tempdir + "/a.gob", "testdata/a.1.fasta"}, &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{})
+	c.Check(exited, check.Equals, 1)
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/tiling"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// An indexed library file contains the same data as a library gob
+// stream, but can be read without decoding the whole file. Layout:
+//
+//	magic
+//	records (each CompactGenome and TileVariant, in input order)
+//	gob-encoded libraryIndex
+//	8-byte little-endian offset of libraryIndex
+//	magic
+//
+// Records use a compact varint encoding (see encodeCompactGenome and
+// encodeTileVariant) so each one can be decoded on its own.
+//
+// Version 2 added no-call ranges to TileVariant records, version 3
+// added spans to CompactGenome records, and version 4 added unphased
+// tags to CompactGenome records.
+var indexedLibraryMagic = []byte("lightning indexed library v4\n")
+
+type indexRecord struct {
+	Offset int64
+	Length int64
+}
+
+type libraryIndex struct {
+	TagSet [][]byte
+	// Genomes[i] is the location of the CompactGenome named
+	// GenomeNames[i]
+	GenomeNames []string
+	Genomes     []indexRecord
+	// TileVariants[tag] lists the locations of all variants of
+	// the given tag
+	TileVariants [][]indexRecord
+	TagPositions []tagPosition
+}
+
+// IndexedLibrary provides random access to the genomes and tile
+// variants in an indexed library file.
+type IndexedLibrary struct {
+	rdr     io.ReaderAt
+	index   libraryIndex
+	genomes map[string]int
+}
+
+// OpenIndexedLibrary reads the index of an indexed library file with
+// the given size.
+func OpenIndexedLibrary(rdr io.ReaderAt, size int64) (*IndexedLibrary, error) {
+	magiclen := int64(len(indexedLibraryMagic))
+	if size < magiclen*2+8 {
+		return nil, errors.New("not an indexed library: file too short")
+	}
+	head := make([]byte, magiclen)
+	if _, err := rdr.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	tail := make([]byte, magiclen+8)
+	if _, err := rdr.ReadAt(tail, size-magiclen-8); err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(head, []byte("lightning indexed library v")) && !bytes.Equal(head, indexedLibraryMagic) {
+		return nil, errors.New("unsupported indexed library version: rebuild it from the original library with index-library")
+	} else if !bytes.Equal(head, indexedLibraryMagic) || !bytes.Equal(tail[8:], indexedLibraryMagic) {
+		return nil, errors.New("not an indexed library: magic number mismatch")
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(tail))
+	if indexOffset < magiclen || indexOffset > size-magiclen-8 {
+		return nil, fmt.Errorf("corrupt indexed library: index offset %d out of range", indexOffset)
+	}
+	lib := &IndexedLibrary{rdr: rdr}
+	err := gob.NewDecoder(io.NewSectionReader(rdr, indexOffset, size-magiclen-8-indexOffset)).Decode(&lib.index)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt indexed library: error decoding index: %s", err)
+	}
+	lib.genomes = make(map[string]int, len(lib.index.GenomeNames))
+	for i, name := range lib.index.GenomeNames {
+		if _, dup := lib.genomes[name]; !dup {
+			lib.genomes[name] = i
+		}
+	}
+	return lib, nil
+}
+
+// TagSet returns the tag set the library was built with (nil if
+// unknown).
+func (lib *IndexedLibrary) TagSet() [][]byte {
+	return lib.index.TagSet
+}
+
+// TagPositions returns the reference positions of the tags, if known
+// (see import -ref).
+func (lib *IndexedLibrary) TagPositions() []tagPosition {
+	return lib.index.TagPositions
+}
+
+// GenomeNames returns the names of all genomes in the library, in
+// the order they were added. A library can have more than one genome
+// with the same name (e.g., after merging libraries); use
+// CompactGenomeAt to get all of them.
+func (lib *IndexedLibrary) GenomeNames() []string {
+	return lib.index.GenomeNames
+}
+
+// TagCount returns one more than the highest tag ID that has any tile
+// variants in the library.
+func (lib *IndexedLibrary) TagCount() int {
+	return len(lib.index.TileVariants)
+}
+
+// CompactGenome returns the genome with the given name. If there is
+// more than one, it returns the first one added.
+func (lib *IndexedLibrary) CompactGenome(name string) (CompactGenome, error) {
+	i, ok := lib.genomes[name]
+	if !ok {
+		return CompactGenome{}, fmt.Errorf("genome %q not found", name)
+	}
+	return lib.CompactGenomeAt(i)
+}
+
+// CompactGenomeAt returns the i'th genome in the library, i.e., the
+// one named GenomeNames()[i].
+func (lib *IndexedLibrary) CompactGenomeAt(i int) (CompactGenome, error) {
+	if i < 0 || i >= len(lib.index.Genomes) {
+		return CompactGenome{}, fmt.Errorf("genome index %d out of range", i)
+	}
+	buf, err := lib.readRecord(lib.index.Genomes[i])
+	if err != nil {
+		return CompactGenome{}, err
+	}
+	return decodeCompactGenome(buf)
+}
+
+// TileVariants returns all variants of the given tag.
+func (lib *IndexedLibrary) TileVariants(tag tagID) ([]TileVariant, error) {
+	if tag < 0 || int(tag) >= len(lib.index.TileVariants) {
+		return nil, nil
+	}
+	var tvs []TileVariant
+	for _, rec := range lib.index.TileVariants[tag] {
+		buf, err := lib.readRecord(rec)
+		if err != nil {
+			return nil, err
+		}
+		tv, err := decodeTileVariant(buf)
+		if err != nil {
+			return nil, err
+		}
+		tvs = append(tvs, tv)
+	}
+	return tvs, nil
+}
+
+func (lib *IndexedLibrary) readRecord(rec indexRecord) ([]byte, error) {
+	buf := make([]byte, rec.Length)
+	_, err := lib.rdr.ReadAt(buf, rec.Offset)
+	return buf, err
+}
+
+// indexedLibraryWriter writes an indexed library file.
+type indexedLibraryWriter struct {
+	w      *bufio.Writer
+	offset int64
+	index  libraryIndex
+	buf    []byte
+}
+
+func newIndexedLibraryWriter(w io.Writer) (*indexedLibraryWriter, error) {
+	iw := &indexedLibraryWriter{w: bufio.NewWriter(w)}
+	return iw, iw.write(indexedLibraryMagic)
+}
+
+func (iw *indexedLibraryWriter) write(buf []byte) error {
+	n, err := iw.w.Write(buf)
+	iw.offset += int64(n)
+	return err
+}
+
+// Add writes the genomes and tile variants in the given entry, and
+// adds its tag positions (if any) to the index.
+func (iw *indexedLibraryWriter) Add(ent *LibraryEntry) error {
+	if err := checkTagSet(&iw.index.TagSet, ent.TagSet); err != nil {
+		return err
+	}
+	iw.index.TagPositions = append(iw.index.TagPositions, ent.TagPositions...)
+	for _, tv := range ent.TileVariants {
+		if tv.Tag < 0 {
+			return fmt.Errorf("invalid tag ID %d", tv.Tag)
+		}
+		rec := indexRecord{Offset: iw.offset}
+		iw.buf = encodeTileVariant(iw.buf[:0], tv)
+		if err := iw.write(iw.buf); err != nil {
+			return err
+		}
+		rec.Length = iw.offset - rec.Offset
+		for len(iw.index.TileVariants) <= int(tv.Tag) {
+			iw.index.TileVariants = append(iw.index.TileVariants, nil)
+		}
+		iw.index.TileVariants[tv.Tag] = append(iw.index.TileVariants[tv.Tag], rec)
+	}
+	for _, cg := range ent.CompactGenomes {
+		rec := indexRecord{Offset: iw.offset}
+		iw.buf = encodeCompactGenome(iw.buf[:0], cg)
+		if err := iw.write(iw.buf); err != nil {
+			return err
+		}
+		rec.Length = iw.offset - rec.Offset
+		iw.index.GenomeNames = append(iw.index.GenomeNames, cg.Name)
+		iw.index.Genomes = append(iw.index.Genomes, rec)
+	}
+	return nil
+}
+
+// Close writes the index and trailer, and flushes the underlying
+// writer. It does not close the underlying writer.
+func (iw *indexedLibraryWriter) Close() error {
+	indexOffset := iw.offset
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(iw.index); err != nil {
+		return err
+	}
+	if err := iw.write(buf.Bytes()); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint64(trailer[:], uint64(indexOffset))
+	if err := iw.write(trailer[:]); err != nil {
+		return err
+	}
+	if err := iw.write(indexedLibraryMagic); err != nil {
+		return err
+	}
+	return iw.w.Flush()
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+func encodeCompactGenome(buf []byte, cg CompactGenome) []byte {
+	buf = appendUvarint(buf, uint64(len(cg.Name)))
+	buf = append(buf, cg.Name...)
+	buf = appendUvarint(buf, uint64(len(cg.Variants)))
+	for _, v := range cg.Variants {
+		buf = appendUvarint(buf, uint64(v))
+	}
+	buf = appendUvarint(buf, uint64(len(cg.Spans)))
+	for _, span := range cg.Spans {
+		buf = appendUvarint(buf, uint64(span.Index))
+		buf = appendUvarint(buf, uint64(span.Span))
+	}
+	buf = appendUvarint(buf, uint64(len(cg.UnphasedTags)))
+	for _, tag := range cg.UnphasedTags {
+		buf = appendUvarint(buf, uint64(tag))
+	}
+	return buf
+}
+
+func encodeTileVariant(buf []byte, tv TileVariant) []byte {
+	buf = appendUvarint(buf, uint64(tv.Tag))
+	buf = appendUvarint(buf, uint64(tv.Variant))
+	buf = append(buf, tv.Blake2b[:]...)
+	buf = appendUvarint(buf, uint64(len(tv.Sequence)))
+	buf = append(buf, tv.Sequence...)
+	buf = appendUvarint(buf, uint64(len(tv.NoCalls)))
+	for _, nc := range tv.NoCalls {
+		buf = appendUvarint(buf, uint64(nc.Start))
+		buf = appendUvarint(buf, uint64(nc.End-nc.Start))
+	}
+	return buf
+}
+
+// recordDecoder reads the fields of a single record, remembering the
+// first error.
+type recordDecoder struct {
+	buf []byte
+	err error
+}
+
+func (dec *recordDecoder) uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(dec.buf)
+	if n <= 0 {
+		dec.err = errors.New("corrupt indexed library: bad varint in record")
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return x
+}
+
+func (dec *recordDecoder) bytes(n uint64) []byte {
+	if dec.err != nil {
+		return nil
+	} else if uint64(len(dec.buf)) < n {
+		dec.err = errors.New("corrupt indexed library: truncated record")
+		return nil
+	}
+	ret := dec.buf[:n]
+	dec.buf = dec.buf[n:]
+	return ret
+}
+
+func decodeCompactGenome(buf []byte) (CompactGenome, error) {
+	dec := recordDecoder{buf: buf}
+	var cg CompactGenome
+	cg.Name = string(dec.bytes(dec.uvarint()))
+	n := dec.uvarint()
+	if dec.err == nil && n > uint64(len(dec.buf)) {
+		// each variant takes at least one byte
+		return cg, errors.New("corrupt indexed library: truncated record")
+	}
+	cg.Variants = make([]tileVariantID, n)
+	for i := range cg.Variants {
+		cg.Variants[i] = tileVariantID(dec.uvarint())
+	}
+	n = dec.uvarint()
+	if dec.err == nil && n > uint64(len(dec.buf))/2 {
+		// each span takes at least two bytes
+		return cg, errors.New("corrupt indexed library: truncated record")
+	}
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		cg.Spans = append(cg.Spans, TileSpan{Index: int(dec.uvarint()), Span: int(dec.uvarint())})
+	}
+	n = dec.uvarint()
+	if dec.err == nil && n > uint64(len(dec.buf)) {
+		// each tag takes at least one byte
+		return cg, errors.New("corrupt indexed library: truncated record")
+	}
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		cg.UnphasedTags = append(cg.UnphasedTags, tagID(dec.uvarint()))
+	}
+	return cg, dec.err
+}
+
+func decodeTileVariant(buf []byte) (TileVariant, error) {
+	dec := recordDecoder{buf: buf}
+	var tv TileVariant
+	tv.Tag = tagID(dec.uvarint())
+	tv.Variant = tileVariantID(dec.uvarint())
+	copy(tv.Blake2b[:], dec.bytes(blake2b.Size256))
+	tv.Sequence = dec.bytes(dec.uvarint())
+	n := dec.uvarint()
+	if dec.err == nil && n > uint64(len(dec.buf))/2 {
+		// each range takes at least two bytes
+		return tv, errors.New("corrupt indexed library: truncated record")
+	}
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		start := int(dec.uvarint())
+		tv.NoCalls = append(tv.NoCalls, tiling.NoCallRange{Start: start, End: start + int(dec.uvarint())})
+	}
+	return tv, dec.err
+}
+
+type indexLibrary struct{}
+
+func (cmd *indexLibrary) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputFilename := flags.String("i", "-", "input `file` (library gob stream)")
+	outputFilename := flags.String("o", "-", "output `file` (indexed library)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning index-library",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(inputFilename)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"index-library", "-local=true", "-i", *inputFilename, "-o", "/mnt/output/library.idx"}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/library.idx")
+		return 0
+	}
+
+	var input io.ReadCloser
+	if *inputFilename == "-" {
+		input = ioutil.NopCloser(stdin)
+	} else {
+		input, err = os.Open(*inputFilename)
+		if err != nil {
+			return 1
+		}
+		defer input.Close()
+	}
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	iw, err := newIndexedLibraryWriter(output)
+	if err != nil {
+		return 1
+	}
+	err = DecodeLibrary(bufio.NewReader(input), iw.Add)
+	if err != nil {
+		return 1
+	}
+	err = iw.Close()
+	if err != nil {
+		return 1
+	}
+	log.Printf("wrote %d genomes, tile variants for %d tags", len(iw.index.Genomes), len(iw.index.TileVariants))
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+type unindexLibrary struct{}
+
+func (cmd *unindexLibrary) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputFilename := flags.String("i", "-", "input `file` (indexed library)")
+	outputFilename := flags.String("o", "-", "output `file` (library gob stream)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning unindex-library",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(inputFilename)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"unindex-library", "-local=true", "-i", *inputFilename, "-o", "/mnt/output/library.gob"}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/library.gob")
+		return 0
+	}
+
+	infile, cleanup, err := spoolInput(*inputFilename, stdin)
+	if err != nil {
+		return 1
+	}
+	defer cleanup()
+	input, err := os.Open(infile)
+	if err != nil {
+		return 1
+	}
+	defer input.Close()
+	fi, err := input.Stat()
+	if err != nil {
+		return 1
+	}
+	lib, err := OpenIndexedLibrary(input, fi.Size())
+	if err != nil {
+		return 1
+	}
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	bufw := bufio.NewWriter(output)
+	enc, err := newLibraryEncoder(bufw)
+	if err != nil {
+		return 1
+	}
+	if tagset := lib.TagSet(); len(tagset) > 0 {
+		err = enc.Encode(LibraryEntry{TagSet: tagset})
+		if err != nil {
+			return 1
+		}
+	}
+	if tps := lib.TagPositions(); len(tps) > 0 {
+		err = enc.Encode(LibraryEntry{TagPositions: tps})
+		if err != nil {
+			return 1
+		}
+	}
+	for tag := 0; tag < lib.TagCount(); tag++ {
+		var tvs []TileVariant
+		tvs, err = lib.TileVariants(tagID(tag))
+		if err != nil {
+			return 1
+		}
+		if len(tvs) == 0 {
+			continue
+		}
+		err = enc.Encode(LibraryEntry{TileVariants: tvs})
+		if err != nil {
+			return 1
+		}
+	}
+	for i := range lib.GenomeNames() {
+		var cg CompactGenome
+		cg, err = lib.CompactGenomeAt(i)
+		if err != nil {
+			return 1
+		}
+		err = enc.Encode(LibraryEntry{CompactGenomes: []CompactGenome{cg}})
+		if err != nil {
+			return 1
+		}
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type indexSuite struct{}
+
+var _ = check.Suite(&indexSuite{})
+
+func (s *indexSuite) TestIndexedLibrary(c *check.C) {
+	var imported bytes.Buffer
+	// Use -partial-tiles so the library has some tile variants
+	// with no-call ranges.
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-partial-tiles", "-tag-library", "testdata/tags", "testdata/a.1.fasta"}, &bytes.Buffer{}, &imported, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	var expectGenomes []CompactGenome
+	expectVariants := map[tagID][]TileVariant{}
+	err := DecodeLibrary(bytes.NewReader(imported.Bytes()), func(ent *LibraryEntry) error {
+		expectGenomes = append(expectGenomes, ent.CompactGenomes...)
+		for _, tv := range ent.TileVariants {
+			expectVariants[tv.Tag] = append(expectVariants[tv.Tag], tv)
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(expectVariants[5][0].NoCalls, check.Not(check.HasLen), 0)
+
+	var indexed bytes.Buffer
+	exited = (&indexLibrary{}).RunCommand("index-library", []string{"-local=true"}, bytes.NewReader(imported.Bytes()), &indexed, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	lib, err := OpenIndexedLibrary(bytes.NewReader(indexed.Bytes()), int64(indexed.Len()))
+	c.Assert(err, check.IsNil)
+	c.Check(lib.TagSet(), check.HasLen, 9)
+	c.Check(lib.GenomeNames(), check.DeepEquals, []string{"testdata/a.1.fasta"})
+	cg, err := lib.CompactGenome("testdata/a.1.fasta")
+	c.Assert(err, check.IsNil)
+	c.Check(cg, check.DeepEquals, expectGenomes[0])
+	_, err = lib.CompactGenome("nonexistent")
+	c.Check(err, check.NotNil)
+	for tag := tagID(0); tag < 9; tag++ {
+		tvs, err := lib.TileVariants(tag)
+		c.Assert(err, check.IsNil)
+		c.Check(tvs, check.DeepEquals, expectVariants[tag])
+	}
+
+	_, err = OpenIndexedLibrary(bytes.NewReader(imported.Bytes()), int64(imported.Len()))
+	c.Check(err, check.ErrorMatches, `not an indexed library.*`)
+
+	var unindexed bytes.Buffer
+	exited = (&unindexLibrary{}).RunCommand("unindex-library", []string{"-local=true"}, bytes.NewReader(indexed.Bytes()), &unindexed, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs, tagset, err := ReadCompactGenomes(&unindexed)
+	c.Assert(err, check.IsNil)
+	c.Check(tagset, check.DeepEquals, lib.TagSet())
+	c.Check(cgs, check.DeepEquals, expectGenomes)
+}
+
+func (s *indexSuite) TestCompactGenomeRecord(c *check.C) {
+	cg := CompactGenome{
+		Name:         "a",
+		Variants:     []tileVariantID{1, 2, 0, 300},
+		Spans:        []TileSpan{{Index: 1, Span: 2}},
+		UnphasedTags: []tagID{0, 1},
+	}
+	buf := encodeCompactGenome(nil, cg)
+	decoded, err := decodeCompactGenome(buf)
+	c.Check(err, check.IsNil)
+	c.Check(decoded, check.DeepEquals, cg)
+	_, err = decodeCompactGenome(buf[:len(buf)-1])
+	c.Check(err, check.ErrorMatches, `corrupt indexed library.*`)
+}
+
+func (s *indexSuite) TestDuplicateGenomeNames(c *check.C) {
+	genomes := []CompactGenome{
+		{Name: "dup", Variants: []tileVariantID{1, 2}},
+		{Name: "other", Variants: []tileVariantID{2, 2}},
+		{Name: "dup", Variants: []tileVariantID{2, 1}},
+	}
+	var buf bytes.Buffer
+	enc, err := newLibraryEncoder(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(enc.Encode(LibraryEntry{CompactGenomes: genomes}), check.IsNil)
+
+	var indexed bytes.Buffer
+	exited := (&indexLibrary{}).RunCommand("index-library", []string{"-local=true"}, &buf, &indexed, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	lib, err := OpenIndexedLibrary(bytes.NewReader(indexed.Bytes()), int64(indexed.Len()))
+	c.Assert(err, check.IsNil)
+	c.Check(lib.GenomeNames(), check.DeepEquals, []string{"dup", "other", "dup"})
+	cg, err := lib.CompactGenome("dup")
+	c.Assert(err, check.IsNil)
+	c.Check(cg, check.DeepEquals, genomes[0])
+	cg, err = lib.CompactGenomeAt(2)
+	c.Assert(err, check.IsNil)
+	c.Check(cg, check.DeepEquals, genomes[2])
+	_, err = lib.CompactGenomeAt(3)
+	c.Check(err, check.NotNil)
+
+	var unindexed bytes.Buffer
+	exited = (&unindexLibrary{}).RunCommand("unindex-library", []string{"-local=true"}, bytes.NewReader(indexed.Bytes()), &unindexed, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs, _, err := ReadCompactGenomes(&unindexed)
+	c.Assert(err, check.IsNil)
+	c.Check(cgs, check.DeepEquals, genomes)
+}
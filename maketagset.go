@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/tiling"
+	log "github.com/sirupsen/logrus"
+)
+
+// candidatesPerWindow is the number of candidate tags to consider in
+// each window, in case some of them turn out not to be unique. The
+// candidates are spread across the window (one in each "slot" of
+// spacing/candidatesPerWindow bases) so a short repeat does not
+// disqualify all of them.
+const candidatesPerWindow = 4
+
+type tagCandidate struct {
+	key    kmerKey // forward strand key
+	chrom  int
+	pos    int
+	window int
+	slot   int
+}
+
+type tagsetMaker struct {
+	refFile        string
+	spacing        int
+	taglen         int
+	skipSoftmasked bool
+
+	chroms     []string
+	roller     *kmerRoller
+	candidates []tagCandidate
+	// count[key] is the number of times the candidate with the
+	// given canonical key occurs in the reference (on either
+	// strand), up to 2
+	count map[kmerKey]uint8
+}
+
+func (cmd *tagsetMaker) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	flags.StringVar(&cmd.refFile, "ref", "", "reference fasta `file`")
+	flags.IntVar(&cmd.spacing, "spacing", 250, "approximate distance between tags (`bases`)")
+	flags.IntVar(&cmd.taglen, "taglen", 24, "tag length (`bases`, at most 32)")
+	flags.BoolVar(&cmd.skipSoftmasked, "skip-softmasked", false, "do not use soft-masked (lower case) reference sequence for tags")
+	outputFilename := flags.String("o", "-", "output `file` (fasta)")
+	bedFilename := flags.String("bed", "", "also write tag positions to bed `file`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if cmd.refFile == "" {
+		err = errors.New("reference data (-ref) not specified")
+		return 2
+	} else if cmd.taglen < 1 || cmd.taglen > maxKmerLen {
+		err = fmt.Errorf("invalid -taglen %d: must be between 1 and %d", cmd.taglen, maxKmerLen)
+		return 2
+	} else if cmd.spacing < cmd.taglen {
+		err = fmt.Errorf("invalid -spacing %d: must not be less than -taglen", cmd.spacing)
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" || *bedFilename != "" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning make-tagset",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         64000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(&cmd.refFile)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"make-tagset", "-local=true",
+			"-ref", cmd.refFile,
+			"-spacing", fmt.Sprintf("%d", cmd.spacing),
+			"-taglen", fmt.Sprintf("%d", cmd.taglen),
+			fmt.Sprintf("-skip-softmasked=%v", cmd.skipSoftmasked),
+			"-o", "/mnt/output/tagset.fa",
+			"-bed", "/mnt/output/tagset.bed",
+		}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/tagset.fa")
+		return 0
+	}
+
+	// First pass: choose candidate tags at regular intervals.
+	log.Printf("%s: choosing candidate tags", cmd.refFile)
+	err = cmd.scanRef(cmd.addCandidates)
+	if err != nil {
+		return 1
+	}
+	log.Printf("%s: found %d candidates in %d chromosomes", cmd.refFile, len(cmd.candidates), len(cmd.chroms))
+
+	// Second pass: count occurrences of each candidate.
+	log.Printf("%s: counting candidate occurrences", cmd.refFile)
+	cmd.count = make(map[kmerKey]uint8, len(cmd.candidates))
+	for _, cand := range cmd.candidates {
+		cmd.count[canonicalKey(cand.key, cmd.taglen)] = 0
+	}
+	err = cmd.scanRef(cmd.countCandidates)
+	if err != nil {
+		return 1
+	}
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	bufw := bufio.NewWriter(output)
+	var bed io.WriteCloser = nopCloser{ioutil.Discard}
+	if *bedFilename != "" {
+		bed, err = os.OpenFile(*bedFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer bed.Close()
+	}
+	bedw := bufio.NewWriter(bed)
+	err = cmd.writeTags(bufw, bedw)
+	if err != nil {
+		return 1
+	}
+	for _, w := range []*bufio.Writer{bufw, bedw} {
+		err = w.Flush()
+		if err != nil {
+			return 1
+		}
+	}
+	for _, f := range []io.Closer{output, bed} {
+		err = f.Close()
+		if err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// scanRef calls fn for each chunk of sequence data in the reference
+// file. Chromosome names are added to cmd.chroms as they are
+// encountered, so fn can use len(cmd.chroms)-1 as the index of the
+// current chromosome, and cmd.roller is reset at the start of each
+// chromosome.
+func (cmd *tagsetMaker) scanRef(fn func(seq []byte)) error {
+	f, err := os.Open(cmd.refFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(cmd.refFile, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: gzip: %s", cmd.refFile, err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+	cmd.chroms = cmd.chroms[:0]
+	fr := tiling.NewFastaReader(in)
+	buf := make([]byte, 1<<20)
+	for {
+		label, err := fr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", cmd.refFile, err)
+		} else if label == "" && len(cmd.chroms) == 0 {
+			return fmt.Errorf("%s: sequence data before first fasta header", cmd.refFile)
+		}
+		cmd.chroms = append(cmd.chroms, strings.SplitN(label, " ", 2)[0])
+		cmd.roller = newKmerRoller(cmd.taglen)
+		for {
+			n, err := fr.Read(buf)
+			fn(buf[:n])
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("%s: %s", cmd.refFile, err)
+			}
+		}
+	}
+	return f.Close()
+}
+
+// addCandidates adds the first suitable k-mer starting in each slot
+// of each window as a candidate tag.
+func (cmd *tagsetMaker) addCandidates(seq []byte) {
+	cmd.roll(seq, func(kr *kmerRoller) {
+		start := kr.pos - cmd.taglen
+		window := start / cmd.spacing
+		slot := (start % cmd.spacing) * candidatesPerWindow / cmd.spacing
+		chrom := len(cmd.chroms) - 1
+		if n := len(cmd.candidates); n > 0 {
+			last := cmd.candidates[n-1]
+			if last.chrom == chrom && start < last.pos+cmd.taglen {
+				// overlaps previous candidate
+				return
+			} else if last.chrom == chrom && last.window == window && last.slot == slot {
+				// already have a candidate in this slot
+				return
+			}
+		}
+		if lowComplexity(kr.key, cmd.taglen) || (cmd.skipSoftmasked && kr.lower > 0) {
+			return
+		}
+		cmd.candidates = append(cmd.candidates, tagCandidate{
+			key:    kr.key,
+			chrom:  chrom,
+			pos:    start,
+			window: window,
+			slot:   slot,
+		})
+	})
+}
+
+func (cmd *tagsetMaker) countCandidates(seq []byte) {
+	cmd.roll(seq, func(kr *kmerRoller) {
+		key := kr.canonical()
+		if n, ok := cmd.count[key]; ok && n < 2 {
+			cmd.count[key] = n + 1
+		}
+	})
+}
+
+// roll feeds seq to the k-mer roller for the current chromosome and
+// calls fn at each position where the last taglen bases are all acgt.
+func (cmd *tagsetMaker) roll(seq []byte, fn func(kr *kmerRoller)) {
+	kr := cmd.roller
+	for _, b := range seq {
+		if kr.push(b) {
+			fn(kr)
+		}
+	}
+}
+
+// writeTags writes the first unique candidate in each window as a
+// tag, in reference order.
+func (cmd *tagsetMaker) writeTags(fasta, bed io.Writer) error {
+	_, err := fmt.Fprintf(fasta, ">%s taglen=%d spacing=%d\n", cmd.refFile, cmd.taglen, cmd.spacing)
+	if err != nil {
+		return err
+	}
+	tags, emptyWindows := 0, 0
+	seqs := cmd.candidateSequences()
+	for i := 0; i < len(cmd.candidates); {
+		chrom, window := cmd.candidates[i].chrom, cmd.candidates[i].window
+		found := false
+		for ; i < len(cmd.candidates) && cmd.candidates[i].chrom == chrom && cmd.candidates[i].window == window; i++ {
+			cand := cmd.candidates[i]
+			if found || cmd.count[canonicalKey(cand.key, cmd.taglen)] != 1 {
+				continue
+			}
+			found = true
+			_, err = fmt.Fprintf(fasta, "%s\n", seqs[i])
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(bed, "%s\t%d\t%d\t%d\n", cmd.chroms[chrom], cand.pos, cand.pos+cmd.taglen, tags)
+			if err != nil {
+				return err
+			}
+			tags++
+		}
+		if !found {
+			emptyWindows++
+		}
+	}
+	log.Printf("%s: wrote %d tags (%d windows had candidates, but none were unique)", cmd.refFile, tags, emptyWindows)
+	return nil
+}
+
+// candidateSequences returns the (forward strand, lower case)
+// sequence of each candidate.
+func (cmd *tagsetMaker) candidateSequences() [][]byte {
+	seqs := make([][]byte, len(cmd.candidates))
+	for i, cand := range cmd.candidates {
+		seq := make([]byte, cmd.taglen)
+		key := cand.key
+		for j := cmd.taglen - 1; j >= 0; j-- {
+			seq[j] = "acgt"[key&3]
+			key >>= 2
+		}
+		seqs[i] = seq
+	}
+	return seqs
+}
+
+// kmerKey encodes a k-mer (k <= maxKmerLen) using 2 bits per base.
+type kmerKey uint64
+
+const maxKmerLen = 32
+
+// kmerBits[b] is the 2-bit encoding of base b, or -1 if b is not
+// acgt/ACGT.
+var kmerBits = func() [256]int8 {
+	var r [256]int8
+	for i := range r {
+		r[i] = -1
+	}
+	for i, b := range "acgt" {
+		r[b] = int8(i)
+		r[b-'a'+'A'] = int8(i)
+	}
+	return r
+}()
+
+// kmerRoller tracks the key of the last k bases of a sequence, one
+// base at a time.
+type kmerRoller struct {
+	k      int
+	mask   kmerKey
+	rshift uint
+
+	key   kmerKey // last k bases
+	rkey  kmerKey // reverse complement of last k bases
+	valid int     // number of consecutive acgt bases at end
+	pos   int     // number of bases seen so far
+
+	// lowercase[i%k] is true if the i'th base was lowercase
+	lowercase []bool
+	lower     int // number of lowercase bases in last k
+}
+
+func newKmerRoller(k int) *kmerRoller {
+	return &kmerRoller{
+		k:         k,
+		mask:      ^kmerKey(0) >> uint(maxKmerLen*2-k*2),
+		rshift:    uint(k-1) * 2,
+		lowercase: make([]bool, k),
+	}
+}
+
+// push adds a base, and returns true if the last k bases are all
+// acgt.
+func (kr *kmerRoller) push(b byte) bool {
+	i := kr.pos % kr.k
+	if kr.lowercase[i] {
+		kr.lower--
+	}
+	kr.lowercase[i] = b >= 'a' && b <= 'z'
+	if kr.lowercase[i] {
+		kr.lower++
+	}
+	kr.pos++
+	bits := kmerBits[int(b)]
+	if bits < 0 {
+		kr.valid = 0
+		return false
+	}
+	kr.key = ((kr.key << 2) | kmerKey(bits)) & kr.mask
+	kr.rkey = (kr.rkey >> 2) | (kmerKey(3-bits) << kr.rshift)
+	kr.valid++
+	return kr.valid >= kr.k
+}
+
+// canonical returns the smaller of the forward and reverse complement
+// keys, so a k-mer has the same canonical key on both strands.
+func (kr *kmerRoller) canonical() kmerKey {
+	if kr.rkey < kr.key {
+		return kr.rkey
+	}
+	return kr.key
+}
+
+// canonicalKey returns the canonical key (see kmerRoller) of the k-mer
+// with the given forward key.
+func canonicalKey(key kmerKey, k int) kmerKey {
+	var rkey kmerKey
+	for j, fwd := 0, key; j < k; j, fwd = j+1, fwd>>2 {
+		rkey = (rkey << 2) | (3 - fwd&3)
+	}
+	if rkey < key {
+		return rkey
+	}
+	return key
+}
+
+// lowComplexity returns true if the k-mer with the given key has
+// fewer than half as many distinct dinucleotides as a k-mer of that
+// length could have (e.g., "acacacac..." or "aaaaaaat...").
+func lowComplexity(key kmerKey, k int) bool {
+	var seen uint16
+	for j := 0; j < k-1; j++ {
+		seen |= 1 << ((key >> uint(j*2)) & 15)
+	}
+	possible := k - 1
+	if possible > 16 {
+		possible = 16
+	}
+	return bits.OnesCount16(seen)*2 < possible
+}
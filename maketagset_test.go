@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/arvados/lightning/tiling"
+	"gopkg.in/check.v1"
+)
+
+type maketagsetSuite struct{}
+
+var _ = check.Suite(&maketagsetSuite{})
+
+func (s *maketagsetSuite) TestMakeTagset(c *check.C) {
+	tempdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempdir)
+
+	rnd := rand.New(rand.NewSource(1))
+	randseq := func(n int) []byte {
+		seq := make([]byte, n)
+		for i := range seq {
+			seq[i] = "acgt"[rnd.Intn(4)]
+		}
+		return seq
+	}
+	chr1 := randseq(6000)
+	copy(chr1[3000:3500], chr1[1000:1500])
+	copy(chr1[4000:4300], bytes.Repeat([]byte{'n'}, 300))
+	chr2 := randseq(2000)
+	ref := map[string][]byte{"chr1": chr1, "chr2": chr2}
+	var fasta bytes.Buffer
+	for _, chrom := range []string{"chr1", "chr2"} {
+		fmt.Fprintf(&fasta, ">%s description\n", chrom)
+		for seq := ref[chrom]; len(seq) > 0; seq = seq[60:] {
+			if len(seq) < 60 {
+				fasta.Write(append(seq, '\n'))
+				break
+			}
+			fasta.Write(append(append([]byte(nil), seq[:60]...), '\n'))
+		}
+	}
+	err = ioutil.WriteFile(tempdir+"/ref.fa", fasta.Bytes(), 0644)
+	c.Assert(err, check.IsNil)
+
+	var tagset bytes.Buffer
+	exited := (&tagsetMaker{}).RunCommand("make-tagset", []string{"-local=true", "-ref", tempdir + "/ref.fa", "-spacing", "200", "-taglen", "24", "-bed", tempdir + "/tags.bed"}, &bytes.Buffer{}, &tagset, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var taglib tiling.TagLibrary
+	err = taglib.Load(bytes.NewReader(tagset.Bytes()))
+	c.Assert(err, check.IsNil)
+	tags := taglib.Tags()
+	bed, err := ioutil.ReadFile(tempdir + "/tags.bed")
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSuffix(string(bed), "\n"), "\n")
+	c.Assert(lines, check.HasLen, len(tags))
+	// 30 windows in chr1, minus 4 with no unique sequence and 1
+	// that is all N, plus 10 windows in chr2.
+	c.Check(tags, check.HasLen, 35)
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		c.Assert(fields, check.HasLen, 4)
+		start, _ := strconv.Atoi(fields[1])
+		end, _ := strconv.Atoi(fields[2])
+		c.Check(string(ref[fields[0]][start:end]), check.Equals, string(tags[i]))
+		c.Check(fields[3], check.Equals, fmt.Sprintf("%d", i))
+		if fields[0] == "chr1" {
+			for _, dup := range [][2]int{{1000, 1500}, {3000, 3500}} {
+				c.Check(start >= dup[0] && end <= dup[1], check.Equals, false, check.Commentf("tag %d at %d-%d is not unique", i, start, end))
+			}
+		}
+	}
+
+	// Tiling the reference finds every tag, in order.
+	tseq, err := tiling.NewTiler(&taglib).TileFasta("ref", bytes.NewReader(fasta.Bytes()))
+	c.Assert(err, check.IsNil)
+	var path []tiling.TileLibRef
+	for _, chrom := range []string{"chr1 description", "chr2 description"} {
+		path = append(path, tseq[chrom]...)
+	}
+	c.Assert(path, check.HasLen, len(tags))
+	for i, ref := range path {
+		c.Check(ref.Tag, check.Equals, tagID(i))
+	}
+}
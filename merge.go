@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/tiling"
+	log "github.com/sirupsen/logrus"
+)
+
+type merger struct {
+	tagset  [][]byte
+	tilelib *tiling.TileLibrary
+	// remap[i][tag][v] is the merged variant ID corresponding to
+	// variant v of the given tag in the i'th input file
+	remap [][][]tileVariantID
+	// index of the input file whose tag positions are copied to
+	// the output, or -1 if none have been seen yet
+	positionsFrom int
+}
+
+func (cmd *merger) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	outputFilename := flags.String("o", "-", "output `file`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning merge",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         64000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		inputs := flags.Args()
+		for i := range inputs {
+			err = runner.TranslatePaths(&inputs[i])
+			if err != nil {
+				return 1
+			}
+		}
+		runner.Args = append([]string{"merge", "-local=true", "-o", "/mnt/output/library.gob"}, inputs...)
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/library.gob")
+		return 0
+	}
+
+	var outfile io.WriteCloser
+	if *outputFilename == "-" {
+		outfile = nopCloser{stdout}
+	} else {
+		outfile, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer outfile.Close()
+	}
+	bufw := bufio.NewWriter(outfile)
+	enc, err := newLibraryEncoder(bufw)
+	if err != nil {
+		return 1
+	}
+	err = cmd.merge(enc, flags.Args())
+	if err != nil {
+		return 1
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = outfile.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// merge reads each input library twice: first to unify the tile
+// variants (by hash) and write them to enc, and then to write the
+// compact genomes with their variants renumbered.
+//
+// Tag positions are copied from the first input that has any; tag
+// positions in other inputs are ignored.
+func (cmd *merger) merge(enc *gob.Encoder, infiles []string) error {
+	cmd.remap = make([][][]tileVariantID, len(infiles))
+	cmd.positionsFrom = -1
+	for i, infile := range infiles {
+		log.Printf("%s: reading tile variants", infile)
+		ignoredPositions := false
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			if len(ent.TagSet) > 0 {
+				if err := checkTagSet(&cmd.tagset, ent.TagSet); err != nil {
+					return err
+				}
+				if cmd.tilelib == nil {
+					cmd.tilelib = tiling.NewTileLibrary(len(cmd.tagset))
+					// inputs may have been imported with
+					// -partial-tiles
+					cmd.tilelib.KeepPartial = true
+					cmd.tilelib.NewVariant = encodeNewTileVariants(enc)
+					if err := enc.Encode(LibraryEntry{TagSet: cmd.tagset}); err != nil {
+						return err
+					}
+				}
+			}
+			for _, tv := range ent.TileVariants {
+				if cmd.tilelib == nil {
+					return errors.New("library has tile variants but no tag set")
+				} else if int(tv.Tag) >= len(cmd.tagset) {
+					return fmt.Errorf("tile variant has tag %d, but tag set only has %d tags", tv.Tag, len(cmd.tagset))
+				}
+				ref, err := cmd.tilelib.GetRef(tv.Tag, tv.Sequence)
+				if err != nil {
+					return err
+				} else if ref.Variant == 0 {
+					return fmt.Errorf("cannot merge tag %d variant %d: sequence contains no-calls", tv.Tag, tv.Variant)
+				}
+				cmd.setRemap(i, tv.Tag, tv.Variant, ref.Variant)
+			}
+			if len(ent.TagPositions) > 0 {
+				if cmd.tilelib == nil {
+					return errors.New("library has tag positions but no tag set")
+				} else if cmd.positionsFrom >= 0 && cmd.positionsFrom != i {
+					ignoredPositions = true
+					return nil
+				}
+				cmd.positionsFrom = i
+				return enc.Encode(LibraryEntry{TagPositions: ent.TagPositions})
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", infile, err)
+		}
+		if ignoredPositions {
+			log.Warnf("%s: ignoring tag positions, using tag positions from %s", infile, infiles[cmd.positionsFrom])
+		}
+	}
+	if cmd.tilelib != nil {
+		log.Printf("merged %d tile variants", cmd.tilelib.Len())
+	}
+	for i, infile := range infiles {
+		log.Printf("%s: writing genomes", infile)
+		err := decodeLibraryFile(infile, func(ent *LibraryEntry) error {
+			if len(ent.CompactGenomes) == 0 {
+				return nil
+			}
+			for _, cg := range ent.CompactGenomes {
+				for idx, v := range cg.Variants {
+					if v == 0 {
+						continue
+					}
+					tag := idx / 2
+					if tag >= len(cmd.remap[i]) || int(v) >= len(cmd.remap[i][tag]) || cmd.remap[i][tag][v] == 0 {
+						return fmt.Errorf("genome %q refers to tag %d variant %d, which is not in the library", cg.Name, tag, v)
+					}
+					cg.Variants[idx] = cmd.remap[i][tag][v]
+				}
+			}
+			return enc.Encode(LibraryEntry{CompactGenomes: ent.CompactGenomes})
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", infile, err)
+		}
+	}
+	return nil
+}
+
+func (cmd *merger) setRemap(input int, tag tagID, from, to tileVariantID) {
+	remap := cmd.remap[input]
+	if len(remap) <= int(tag) {
+		remap = append(remap, make([][]tileVariantID, int(tag)+1-len(remap))...)
+		cmd.remap[input] = remap
+	}
+	if len(remap[tag]) <= int(from) {
+		remap[tag] = append(remap[tag], make([]tileVariantID, int(from)+1-len(remap[tag]))...)
+	}
+	remap[tag][from] = to
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+type mergeSuite struct{}
+
+var _ = check.Suite(&mergeSuite{})
+
+func (s *mergeSuite) TestMerge(c *check.C) {
+	tempdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tempdir)
+
+	// b is the same as a, but with haplotypes swapped.
+	for dst, src := range map[string]string{
+		"a.1.fasta": "a.1.fasta",
+		"a.2.fasta": "a.2.fasta",
+		"b.1.fasta": "a.2.fasta",
+		"b.2.fasta": "a.1.fasta",
+	} {
+		buf, err := ioutil.ReadFile("testdata/" + src)
+		c.Assert(err, check.IsNil)
+		err = ioutil.WriteFile(tempdir+"/"+dst, buf, 0644)
+		c.Assert(err, check.IsNil)
+	}
+	for _, infile := range []string{tempdir + "/a.1.fasta", tempdir + "/b.1.fasta"} {
+		exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-o", infile + ".gob", infile}, &bytes.Buffer{}, &bytes.Buffer{}, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+	}
+
+	var output bytes.Buffer
+	exited := (&merger{}).RunCommand("merge", []string{"-local=true", tempdir + "/a.1.fasta.gob", tempdir + "/b.1.fasta.gob"}, &bytes.Buffer{}, &output, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	cgs, tagset, err := ReadCompactGenomes(&output)
+	c.Assert(err, check.IsNil)
+	c.Check(tagset, check.HasLen, 9)
+	c.Assert(cgs, check.HasLen, 2)
+	c.Check(cgs[0].Name, check.Equals, tempdir+"/a.1.fasta")
+	c.Check(cgs[1].Name, check.Equals, tempdir+"/b.1.fasta")
+	c.Assert(cgs[0].Variants, check.HasLen, len(cgs[1].Variants))
+	for i := 0; i < len(cgs[0].Variants); i += 2 {
+		c.Check(cgs[0].Variants[i], check.Equals, cgs[1].Variants[i+1])
+		c.Check(cgs[0].Variants[i+1], check.Equals, cgs[1].Variants[i])
+	}
+
+	// An existing output file is replaced, not partly
+	// overwritten.
+	err = ioutil.WriteFile(tempdir+"/merged.gob", bytes.Repeat([]byte("x"), 100000), 0644)
+	c.Assert(err, check.IsNil)
+	exited = (&merger{}).RunCommand("merge", []string{"-local=true", "-o", tempdir + "/merged.gob", tempdir + "/a.1.fasta.gob", tempdir + "/b.1.fasta.gob"}, &bytes.Buffer{}, &bytes.Buffer{}, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	f, err := os.Open(tempdir + "/merged.gob")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	merged, _, err := ReadCompactGenomes(f)
+	c.Assert(err, check.IsNil)
+	c.Check(merged, check.DeepEquals, cgs)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/tiling"
+	log "github.com/sirupsen/logrus"
+)
+
+type tagStats struct {
+	Tag                 tagID         `json:"tag"`
+	Chrom               string        `json:"chrom"` // reference position, if known (see import -ref)
+	Start               int           `json:"start"`
+	End                 int           `json:"end"`
+	Variants            int           `json:"variants"`
+	NoCallRate          float64       `json:"nocall_rate"`
+	PartialRate         float64       `json:"partial_rate"`
+	TopVariant          tileVariantID `json:"top_variant"`
+	TopVariantFrequency float64       `json:"top_variant_frequency"`
+}
+
+type genomeStats struct {
+	Name              string  `json:"genome"`
+	CalledFraction    float64 `json:"called_fraction"`
+	PartialFraction   float64 `json:"partial_fraction"`
+	SpanningTiles     int     `json:"spanning_tiles"` // tiles that span more than one tag
+	HeterozygousTiles int     `json:"heterozygous_tiles"`
+	UnphasedTiles     int     `json:"unphased_tiles"` // pairs of tiles with unknown phase
+}
+
+type librarySummary struct {
+	Tags                int `json:"tags"`
+	Genomes             int `json:"genomes"`
+	TileVariants        int `json:"tile_variants"`
+	PartialTileVariants int `json:"partial_tile_variants"`
+}
+
+type libraryStats struct {
+	Summary librarySummary `json:"summary"`
+	Tags    []tagStats     `json:"tags"`
+	Genomes []genomeStats  `json:"genomes"`
+}
+
+type statscmd struct {
+	tagset [][]byte
+	// count[tag][variant] is the number of haplotypes with the
+	// given variant (variant 0 is not counted)
+	count        [][]int
+	tileVariants int
+	// partial[ref] is true if ref is a partial tile variant (i.e.,
+	// it has some no-calls)
+	partial   map[tiling.TileLibRef]bool
+	positions []tagPosition
+	genomes   []genomeStats
+	called    []int // number of tiles called in each genome
+	partials  []int // number of called tiles in each genome that are partial
+}
+
+func (cmd *statscmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputFilename := flags.String("i", "-", "input `file`")
+	outputFilename := flags.String("o", "-", "output `file`")
+	format := flags.String("format", "json", "output `format`: json (all reports) or tsv (one report, see -report)")
+	report := flags.String("report", "tags", "`report` to write in tsv format: summary, tags, or genomes")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	} else if *format != "json" && *format != "tsv" {
+		err = fmt.Errorf("invalid format %q", *format)
+		return 2
+	} else if *report != "summary" && *report != "tags" && *report != "genomes" {
+		err = fmt.Errorf("invalid report %q", *report)
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning stats",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(inputFilename)
+		if err != nil {
+			return 1
+		}
+		outname := "stats.json"
+		if *format == "tsv" {
+			outname = *report + ".tsv"
+		}
+		runner.Args = []string{"stats", "-local=true", "-i", *inputFilename, "-o", "/mnt/output/" + outname, "-format", *format, "-report", *report}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/"+outname)
+		return 0
+	}
+
+	var input io.ReadCloser
+	if *inputFilename == "-" {
+		input = ioutil.NopCloser(stdin)
+	} else {
+		input, err = os.Open(*inputFilename)
+		if err != nil {
+			return 1
+		}
+		defer input.Close()
+	}
+	err = DecodeLibrary(bufio.NewReader(input), cmd.add)
+	if err != nil {
+		return 1
+	}
+	err = input.Close()
+	if err != nil {
+		return 1
+	}
+	stats := cmd.stats()
+
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	bufw := bufio.NewWriter(output)
+	if *format == "json" {
+		enc := json.NewEncoder(bufw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(stats)
+	} else {
+		err = writeStatsTSV(bufw, stats, *report)
+	}
+	if err != nil {
+		return 1
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func (cmd *statscmd) add(ent *LibraryEntry) error {
+	if len(ent.TagSet) > 0 {
+		cmd.tagset = ent.TagSet
+	}
+	cmd.tileVariants += len(ent.TileVariants)
+	cmd.positions = append(cmd.positions, ent.TagPositions...)
+	for _, tv := range ent.TileVariants {
+		if len(tv.NoCalls) > 0 {
+			if cmd.partial == nil {
+				cmd.partial = map[tiling.TileLibRef]bool{}
+			}
+			cmd.partial[tiling.TileLibRef{Tag: tv.Tag, Variant: tv.Variant}] = true
+		}
+	}
+	for _, cg := range ent.CompactGenomes {
+		if ntags := (len(cg.Variants) + 1) / 2; len(cmd.count) < ntags {
+			cmd.count = append(cmd.count, make([][]int, ntags-len(cmd.count))...)
+		}
+		gs := genomeStats{Name: cg.Name, SpanningTiles: len(cg.Spans), UnphasedTiles: len(cg.UnphasedTags)}
+		called, partials := 0, 0
+		for idx, v := range cg.Variants {
+			if v == 0 {
+				continue
+			}
+			called++
+			tag := idx / 2
+			if cmd.partial[tiling.TileLibRef{Tag: tagID(tag), Variant: v}] {
+				partials++
+			}
+			count := cmd.count[tag]
+			if len(count) <= int(v) {
+				count = append(count, make([]int, int(v)+1-len(count))...)
+				cmd.count[tag] = count
+			}
+			count[v]++
+			if idx&1 == 1 && cg.Variants[idx-1] != 0 && cg.Variants[idx-1] != v {
+				gs.HeterozygousTiles++
+			}
+		}
+		cmd.genomes = append(cmd.genomes, gs)
+		cmd.called = append(cmd.called, called)
+		cmd.partials = append(cmd.partials, partials)
+	}
+	return nil
+}
+
+func (cmd *statscmd) stats() libraryStats {
+	ntags := len(cmd.count)
+	if ntags < len(cmd.tagset) {
+		ntags = len(cmd.tagset)
+	}
+	haplotypes := float64(len(cmd.genomes) * 2)
+	stats := libraryStats{
+		Summary: librarySummary{
+			Tags:                ntags,
+			Genomes:             len(cmd.genomes),
+			TileVariants:        cmd.tileVariants,
+			PartialTileVariants: len(cmd.partial),
+		},
+		Tags:    make([]tagStats, ntags),
+		Genomes: cmd.genomes,
+	}
+	for tag := range stats.Tags {
+		ts := tagStats{Tag: tagID(tag)}
+		called, partials := 0, 0
+		if tag < len(cmd.count) {
+			for v, n := range cmd.count[tag] {
+				if n == 0 {
+					continue
+				}
+				ts.Variants++
+				called += n
+				if cmd.partial[tiling.TileLibRef{Tag: tagID(tag), Variant: tileVariantID(v)}] {
+					partials += n
+				}
+				if n > cmd.count[tag][ts.TopVariant] || ts.TopVariant == 0 {
+					ts.TopVariant = tileVariantID(v)
+				}
+			}
+		}
+		if haplotypes > 0 {
+			ts.NoCallRate = 1 - float64(called)/haplotypes
+			ts.PartialRate = float64(partials) / haplotypes
+			if ts.TopVariant > 0 {
+				ts.TopVariantFrequency = float64(cmd.count[tag][ts.TopVariant]) / haplotypes
+			}
+		}
+		stats.Tags[tag] = ts
+	}
+	for _, tp := range cmd.positions {
+		if int(tp.Tag) < ntags {
+			ts := &stats.Tags[tp.Tag]
+			ts.Chrom, ts.Start, ts.End = tp.Chrom, tp.Start, tp.End
+		}
+	}
+	for i := range stats.Genomes {
+		if ntags > 0 {
+			stats.Genomes[i].CalledFraction = float64(cmd.called[i]) / float64(ntags*2)
+			stats.Genomes[i].PartialFraction = float64(cmd.partials[i]) / float64(ntags*2)
+		}
+	}
+	return stats
+}
+
+func writeStatsTSV(w io.Writer, stats libraryStats, report string) error {
+	var err error
+	switch report {
+	case "summary":
+		_, err = fmt.Fprintf(w, "tags\t%d\ngenomes\t%d\ntile_variants\t%d\npartial_tile_variants\t%d\n", stats.Summary.Tags, stats.Summary.Genomes, stats.Summary.TileVariants, stats.Summary.PartialTileVariants)
+	case "tags":
+		_, err = fmt.Fprint(w, "tag\tchrom\tstart\tend\tvariants\tnocall_rate\tpartial_rate\ttop_variant\ttop_variant_frequency\n")
+		for _, ts := range stats.Tags {
+			if err != nil {
+				break
+			}
+			_, err = fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%g\t%g\t%d\t%g\n", ts.Tag, ts.Chrom, ts.Start, ts.End, ts.Variants, ts.NoCallRate, ts.PartialRate, ts.TopVariant, ts.TopVariantFrequency)
+		}
+	case "genomes":
+		_, err = fmt.Fprint(w, "genome\tcalled_fraction\tpartial_fraction\tspanning_tiles\theterozygous_tiles\tunphased_tiles\n")
+		for _, gs := range stats.Genomes {
+			if err != nil {
+				break
+			}
+			_, err = fmt.Fprintf(w, "%s\t%g\t%g\t%d\t%d\t%d\n", gs.Name, gs.CalledFraction, gs.PartialFraction, gs.SpanningTiles, gs.HeterozygousTiles, gs.UnphasedTiles)
+		}
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type statsSuite struct{}
+
+var _ = check.Suite(&statsSuite{})
+
+func (s *statsSuite) TestStats(c *check.C) {
+	var imported bytes.Buffer
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "testdata/a.1.fasta"}, &bytes.Buffer{}, &imported, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var out bytes.Buffer
+	exited = (&statscmd{}).RunCommand("stats", []string{"-local=true"}, bytes.NewReader(imported.Bytes()), &out, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	var stats libraryStats
+	err := json.Unmarshal(out.Bytes(), &stats)
+	c.Assert(err, check.IsNil)
+	c.Check(stats.Summary, check.Equals, librarySummary{Tags: 9, Genomes: 1, TileVariants: 9})
+	c.Assert(stats.Tags, check.HasLen, 9)
+	// Tags 0 and 1 have a different variant on each haplotype,
+	// and tags 5 and 6 are no-calls.
+	c.Check(stats.Tags[0].Variants, check.Equals, 2)
+	c.Check(stats.Tags[0].TopVariantFrequency, check.Equals, 0.5)
+	c.Check(stats.Tags[2].Variants, check.Equals, 1)
+	c.Check(stats.Tags[2].TopVariant, check.Equals, tileVariantID(1))
+	c.Check(stats.Tags[2].TopVariantFrequency, check.Equals, 1.0)
+	c.Check(stats.Tags[5].Variants, check.Equals, 0)
+	c.Check(stats.Tags[5].NoCallRate, check.Equals, 1.0)
+	c.Assert(stats.Genomes, check.HasLen, 1)
+	c.Check(stats.Genomes[0].HeterozygousTiles, check.Equals, 2)
+	c.Check(stats.Genomes[0].CalledFraction, check.Equals, 7.0/9)
+
+	out.Reset()
+	exited = (&statscmd{}).RunCommand("stats", []string{"-local=true", "-format=tsv", "-report=genomes"}, bytes.NewReader(imported.Bytes()), &out, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	c.Check(lines, check.HasLen, 2)
+	c.Check(lines[0], check.Equals, "genome\tcalled_fraction\tpartial_fraction\tspanning_tiles\theterozygous_tiles\tunphased_tiles")
+	c.Check(strings.HasSuffix(lines[1], "\t2\t0"), check.Equals, true)
+}
+
+func (s *statsSuite) TestStatsPartialTiles(c *check.C) {
+	var imported bytes.Buffer
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-partial-tiles", "-tag-library", "testdata/tags", "testdata/a.1.fasta"}, &bytes.Buffer{}, &imported, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	var out bytes.Buffer
+	exited = (&statscmd{}).RunCommand("stats", []string{"-local=true"}, bytes.NewReader(imported.Bytes()), &out, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	var stats libraryStats
+	err := json.Unmarshal(out.Bytes(), &stats)
+	c.Assert(err, check.IsNil)
+	// Tags 5 and 6 have no-calls, so they are partial tiles
+	// instead of missing.
+	c.Check(stats.Summary.PartialTileVariants > 0, check.Equals, true)
+	c.Check(stats.Tags[5].NoCallRate, check.Equals, 0.0)
+	c.Check(stats.Tags[5].PartialRate, check.Equals, 1.0)
+	c.Check(stats.Tags[2].PartialRate, check.Equals, 0.0)
+	c.Assert(stats.Genomes, check.HasLen, 1)
+	c.Check(stats.Genomes[0].CalledFraction, check.Equals, 1.0)
+	c.Check(stats.Genomes[0].PartialFraction, check.Equals, 2.0/9)
+}
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Regenerate the expected consensus sequences for b.vcf
+# (b.consensus.1.fasta and b.consensus.2.fasta) with bcftools.
+set -e
+cd "$(dirname "$0")"
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+bcftools view -Oz -o "$tmp/b.vcf.gz" b.vcf
+bcftools index "$tmp/b.vcf.gz"
+for h in 1 2; do
+	bcftools consensus -f ref -s sample1 -H $h "$tmp/b.vcf.gz" >b.consensus.$h.fasta
+done
@@ -1,8 +0,0 @@
-package main
-
-type Tiler struct {
-}
-
-func newTiler(taglib *tagLibrary) *Tiler {
-	return &Tiler{}
-}
@@ -0,0 +1,157 @@
+package tiling
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// FastaReader reads records from a fasta file. Unlike a
+// bufio.Scanner, it has no limit on line length, and it returns each
+// sequence through an io.Reader so the caller does not need to hold
+// an entire sequence in memory.
+//
+//	fr := NewFastaReader(f)
+//	for {
+//		label, err := fr.Next()
+//		if err == io.EOF {
+//			break
+//		} else if err != nil {
+//			return err
+//		}
+//		// read sequence data from fr until io.EOF
+//	}
+//
+// Sequence data is returned as it appears in the file, except that
+// line breaks and other whitespace are removed.
+type FastaReader struct {
+	r       *bufio.Reader
+	started bool
+	eor     bool   // at end of current record
+	bol     bool   // at beginning of a line
+	pending []byte // data from the current line not yet returned by Read
+	width   int    // length of first line of sequence data
+	widthOK bool   // first line of sequence data has been read
+}
+
+// NewFastaReader returns a FastaReader that reads from r.
+func NewFastaReader(r io.Reader) *FastaReader {
+	return &FastaReader{r: bufio.NewReaderSize(r, 1<<20), bol: true}
+}
+
+// Next skips the rest of the current record (if any) and returns the
+// label of the next record, i.e., the header line without the leading
+// ">". It returns io.EOF if there are no more records.
+//
+// If the input has sequence data before the first header line, the
+// first record has an empty label.
+func (fr *FastaReader) Next() (string, error) {
+	for fr.started && !fr.eor {
+		fr.pending = nil
+		if err := fr.fill(); err != nil {
+			return "", err
+		}
+	}
+	fr.started = true
+	fr.pending = nil
+	for {
+		b, err := fr.r.Peek(1)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '>' {
+			break
+		} else if b[0] != '\n' && b[0] != '\r' {
+			// sequence data without a header
+			fr.eor = false
+			return "", nil
+		}
+		fr.r.ReadByte()
+	}
+	line, err := fr.r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fr.eor, fr.bol = false, true
+	fr.width, fr.widthOK = 0, false
+	return string(bytes.TrimSpace(line[1:])), nil
+}
+
+// LineWidth returns the length of the first line of sequence data in
+// the current record, or 0 if that line has not been read yet.
+func (fr *FastaReader) LineWidth() int {
+	if !fr.widthOK {
+		return 0
+	}
+	return fr.width
+}
+
+// Read reads sequence data from the current record. It returns
+// io.EOF at the end of the record.
+func (fr *FastaReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !fr.eor {
+		if len(fr.pending) == 0 {
+			if err := fr.fill(); err != nil {
+				return n, err
+			}
+			continue
+		}
+		// Copy the run of sequence data up to the next
+		// whitespace (usually the end of the line), then skip
+		// the whitespace.
+		run := fr.pending
+		if len(run) > len(p)-n {
+			run = run[:len(p)-n]
+		}
+		end := 0
+		for end < len(run) && !fastaSpace[run[end]] {
+			end++
+		}
+		n += copy(p[n:], run[:end])
+		fr.pending = fr.pending[end:]
+		for len(fr.pending) > 0 && fastaSpace[fr.pending[0]] {
+			fr.pending = fr.pending[1:]
+		}
+	}
+	if n == 0 && len(p) > 0 && fr.eor {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+var fastaSpace = func() (r [256]bool) {
+	for _, b := range []byte("\n\r \t") {
+		r[b] = true
+	}
+	return
+}()
+
+// fill reads the next part of the current line into fr.pending, or
+// sets fr.eor if there is no more data in the current record.
+func (fr *FastaReader) fill() error {
+	if fr.bol {
+		b, err := fr.r.Peek(1)
+		if err == io.EOF || (err == nil && b[0] == '>') {
+			fr.eor = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	line, err := fr.r.ReadSlice('\n')
+	switch err {
+	case bufio.ErrBufferFull:
+		fr.bol = false
+	case nil, io.EOF:
+		fr.bol = true
+	default:
+		return err
+	}
+	fr.pending = line
+	if !fr.widthOK {
+		fr.width += len(bytes.TrimSpace(line))
+		fr.widthOK = fr.bol && fr.width > 0
+	}
+	return nil
+}
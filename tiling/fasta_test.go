@@ -0,0 +1,88 @@
+package tiling
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type fastaSuite struct{}
+
+var _ = check.Suite(&fastaSuite{})
+
+func (s *fastaSuite) TestFastaReader(c *check.C) {
+	long := strings.Repeat("acgtN", 1<<20)
+	fr := NewFastaReader(bytes.NewBufferString("acgt\nACGT\n\n>chr1 test\r\nac gt\r\nnnnn\r\n\n>chr2\n" + long + "\n>chr3\n>chr4\ntt"))
+	var got []string
+	for {
+		label, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, check.IsNil)
+		seq, err := ioutil.ReadAll(fr)
+		c.Assert(err, check.IsNil)
+		got = append(got, label, string(seq))
+	}
+	c.Check(got, check.DeepEquals, []string{
+		"", "acgtACGT",
+		"chr1 test", "acgtnnnn",
+		"chr2", long,
+		"chr3", "",
+		"chr4", "tt",
+	})
+
+	// Next skips any unread sequence data
+	fr = NewFastaReader(bytes.NewBufferString(">chr1\n" + long + "\n>chr2\nacgt\n"))
+	label, err := fr.Next()
+	c.Check(label, check.Equals, "chr1")
+	c.Assert(err, check.IsNil)
+	buf := make([]byte, 3)
+	n, err := fr.Read(buf)
+	c.Check(string(buf[:n]), check.Equals, "acg")
+	c.Assert(err, check.IsNil)
+	label, err = fr.Next()
+	c.Check(label, check.Equals, "chr2")
+	c.Assert(err, check.IsNil)
+	seq, err := ioutil.ReadAll(fr)
+	c.Check(string(seq), check.Equals, "acgt")
+	c.Assert(err, check.IsNil)
+	_, err = fr.Next()
+	c.Check(err, check.Equals, io.EOF)
+}
+
+func (s *fastaSuite) TestLineWidth(c *check.C) {
+	fr := NewFastaReader(bytes.NewBufferString(">chr1\r\nacgta\r\ncgt\n>chr2\n" + strings.Repeat("a", 1<<17) + "\nacgt\n>chr3\n"))
+	for _, expect := range []int{5, 1 << 17, 0} {
+		_, err := fr.Next()
+		c.Assert(err, check.IsNil)
+		c.Check(fr.LineWidth(), check.Equals, 0)
+		_, err = ioutil.ReadAll(fr)
+		c.Assert(err, check.IsNil)
+		c.Check(fr.LineWidth(), check.Equals, expect)
+	}
+}
+
+// Run with "go test -check.b".
+func (s *fastaSuite) BenchmarkFastaReader(c *check.C) {
+	var fasta bytes.Buffer
+	fasta.WriteString(">chr1\n")
+	for i := 0; i < 1<<14; i++ {
+		fasta.WriteString(strings.Repeat("ACGT", 15) + "\n")
+	}
+	buf := make([]byte, 1<<16)
+	c.SetBytes(int64(fasta.Len()))
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		fr := NewFastaReader(bytes.NewReader(fasta.Bytes()))
+		_, err := fr.Next()
+		c.Assert(err, check.IsNil)
+		for err == nil {
+			_, err = fr.Read(buf)
+		}
+		c.Assert(err, check.Equals, io.EOF)
+	}
+}
@@ -0,0 +1,420 @@
+// Package tiling splits genome sequences into tiles at the locations
+// of a fixed set of short "tag" sequences, and assigns an ID to each
+// distinct tile sequence ("tile variant") found for each tag.
+package tiling
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// tagmapKeySize is the maximum number of bases in a tagmapKey. Tags
+// longer than this are looked up by their first tagmapKeySize bases,
+// and then compared in full.
+const tagmapKeySize = 32
+
+type tagmapKey uint64
+
+// TagID identifies a tag by its 0-based position in the tag set.
+type TagID int32
+
+type tagInfo struct {
+	id     TagID // 0-based position in input tagset
+	tagseq []byte
+}
+
+// tagTable holds the tags whose keys have a given length, i.e., tags
+// of length keylen, or (if keylen == tagmapKeySize) all tags at least
+// that long.
+type tagTable struct {
+	keylen  int
+	keymask tagmapKey
+	tagmap  map[tagmapKey]tagInfo
+	// tags that have the same key as the tag in tagmap (only
+	// possible for tags longer than tagmapKeySize)
+	more map[tagmapKey][]tagInfo
+}
+
+// TagLibrary finds the locations of tags in a sequence.
+type TagLibrary struct {
+	tags   [][]byte
+	tables []*tagTable // in order of decreasing keylen
+	maxlen int         // length of longest tag
+}
+
+// Load reads tags from a fasta file, one tag per line. Header lines
+// are ignored.
+func (taglib *TagLibrary) Load(rdr io.Reader) error {
+	var seqs [][]byte
+	r := bufio.NewReader(rdr)
+	for {
+		data, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		data = bytes.TrimRight(data, "\r\n")
+		if len(data) > 0 && data[0] == '>' {
+		} else if len(data) > 0 || err == nil {
+			seqs = append(seqs, data)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return taglib.SetTags(seqs)
+}
+
+// FindAll calls fn for each occurrence of a tag in buf, in order of
+// position.
+//
+// Occurrences of a tag's reverse complement are reported with
+// rev=true. In that case pos is the position of the first base of the
+// reverse-complemented tag in buf (i.e., its position on the forward
+// strand), so buf[pos:pos+taglen] is the reverse complement of the
+// tag. A palindromic tag is reported as a forward match.
+//
+// Overlapping occurrences are not reported: after a match, the next
+// match must start after the end of the matched tag. If tags of
+// different lengths match at the same position, the longest one is
+// reported.
+func (taglib *TagLibrary) FindAll(buf []byte, fn func(id TagID, pos, taglen int, rev bool)) {
+	finder := tagFinder{taglib: taglib}
+	finder.scan(buf, 0, len(buf), fn)
+}
+
+// tagFinder finds tags in a sequence that is supplied in pieces.
+type tagFinder struct {
+	taglib    *TagLibrary
+	key, rkey tagmapKey
+	valid     int // if valid < keylen, key has "no data" zeroes that are otherwise indistinguishable from "A"
+}
+
+// scan continues the search with buf[start:end], calling fn for each
+// tag found (as in FindAll, with positions relative to buf).
+//
+// When scanning a sequence in pieces, buf[:start] must include the
+// last lookbehind() bases already scanned, and buf[end:] must include
+// the next lookahead() bases (or the rest of the sequence, if
+// shorter). Otherwise, tags longer than tagmapKeySize can be missed.
+func (finder *tagFinder) scan(buf []byte, start, end int, fn func(id TagID, pos, taglen int, rev bool)) {
+	key, rkey, valid := finder.key, finder.rkey, finder.valid
+	for i := start; i < end; i++ {
+		base := buf[i]
+		if !isbase[int(base)] {
+			valid = 0
+			continue
+		}
+		key = (key << 2) | twobit[int(base)]
+		// rkey is the reverse complement of the last
+		// tagmapKeySize bases
+		rkey = (rkey >> 2) | ((3 - twobit[int(base)]) << (tagmapKeySize*2 - 2))
+		valid++
+
+		for _, table := range finder.taglib.tables {
+			if valid < table.keylen {
+				continue
+			}
+			if taginfo, ok := table.find(key&table.keymask, buf, i-table.keylen+1, false); ok {
+				fn(taginfo.id, i-table.keylen+1, len(taginfo.tagseq), false)
+				// don't try to match overlapping tags
+				valid = table.keylen - len(taginfo.tagseq)
+				break
+			}
+			if taginfo, ok := table.find(rkey>>uint(tagmapKeySize*2-table.keylen*2), buf, i+1, true); ok {
+				fn(taginfo.id, i-len(taginfo.tagseq)+1, len(taginfo.tagseq), true)
+				valid = 0
+				break
+			}
+		}
+	}
+	finder.key, finder.rkey, finder.valid = key, rkey, valid
+}
+
+// minScanPiece is the smallest amount of sequence data scanParallel
+// assigns to each goroutine.
+var minScanPiece = 1 << 16
+
+// tagMatch is a tag occurrence found by a tagFinder.
+type tagMatch struct {
+	id     TagID
+	pos    int
+	taglen int
+	rev    bool
+}
+
+// scanParallel is like scan, but splits buf[start:end] into pieces
+// and scans them concurrently, using up to threads goroutines. The
+// tags found are the same as with scan.
+//
+// Each piece after the first is scanned with a fresh tagFinder,
+// which might not find the same tags as a sequential scan near the
+// start of the piece. To stitch the pieces together, the start of
+// each piece is rescanned (sequentially, continuing from the end of
+// the previous piece) until it finds a tag that the fresh tagFinder
+// also found. From there on, the two scans agree.
+func (finder *tagFinder) scanParallel(buf []byte, start, end, threads int, fn func(id TagID, pos, taglen int, rev bool)) {
+	npieces := (end - start) / minScanPiece
+	if npieces > threads {
+		npieces = threads
+	}
+	if npieces < 2 {
+		finder.scan(buf, start, end, fn)
+		return
+	}
+	type piece struct {
+		start, end int
+		finder     tagFinder
+		found      []tagMatch
+	}
+	pieces := make([]piece, npieces)
+	var wg sync.WaitGroup
+	for i := range pieces {
+		p := &pieces[i]
+		p.start = start + (end-start)*i/npieces
+		p.end = start + (end-start)*(i+1)/npieces
+		if i == 0 {
+			p.finder = *finder
+		} else {
+			p.finder = tagFinder{taglib: finder.taglib}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.finder.scan(buf, p.start, p.end, func(id TagID, pos, taglen int, rev bool) {
+				p.found = append(p.found, tagMatch{id, pos, taglen, rev})
+			})
+		}()
+	}
+	wg.Wait()
+
+	for i, p := range pieces {
+		found := p.found
+		if i > 0 {
+			synced := false
+			for pos := p.start; pos < p.end && !synced; pos++ {
+				finder.scan(buf, pos, pos+1, func(id TagID, pos, taglen int, rev bool) {
+					m := tagMatch{id, pos, taglen, rev}
+					fn(m.id, m.pos, m.taglen, m.rev)
+					for len(found) > 0 && found[0].pos < m.pos {
+						found = found[1:]
+					}
+					if len(found) > 0 && found[0] == m {
+						found = found[1:]
+						synced = true
+					}
+				})
+			}
+			if !synced {
+				continue
+			}
+		}
+		for _, m := range found {
+			fn(m.id, m.pos, m.taglen, m.rev)
+		}
+		*finder = p.finder
+	}
+}
+
+// lookbehind returns the number of bases before the scan position
+// that are needed to match reverse complements of tags.
+func (finder *tagFinder) lookbehind() int {
+	return finder.taglib.maxlen
+}
+
+// lookahead returns the number of bases after the scan position that
+// are needed to match long tags.
+func (finder *tagFinder) lookahead() int {
+	if finder.taglib.maxlen > tagmapKeySize {
+		return finder.taglib.maxlen - tagmapKeySize
+	}
+	return 0
+}
+
+// find returns the tag with the given key that occurs in buf.
+//
+// If rev is false, the tag must occur on the forward strand starting
+// at buf[pos]. If rev is true, its reverse complement must occur
+// ending at buf[pos-1].
+func (table *tagTable) find(key tagmapKey, buf []byte, pos int, rev bool) (tagInfo, bool) {
+	taginfo, ok := table.tagmap[key]
+	if !ok {
+		return taginfo, false
+	} else if len(taginfo.tagseq) == table.keylen {
+		// key is the entire tag
+		return taginfo, true
+	}
+	for _, taginfo := range append([]tagInfo{taginfo}, table.more[key]...) {
+		taglen := len(taginfo.tagseq)
+		if rev {
+			if pos >= taglen && bytes.EqualFold(taginfo.tagseq, ReverseComplement(buf[pos-taglen:pos])) {
+				return taginfo, true
+			}
+		} else if pos+taglen <= len(buf) && bytes.EqualFold(taginfo.tagseq, buf[pos:pos+taglen]) {
+			return taginfo, true
+		}
+	}
+	return tagInfo{}, false
+}
+
+// ReverseComplement returns a new slice containing the reverse
+// complement of seq. Bases other than acgt/ACGT (e.g., "n") are
+// copied unchanged.
+func ReverseComplement(seq []byte) []byte {
+	rc := make([]byte, len(seq))
+	for i, b := range seq {
+		rc[len(seq)-1-i] = complement[int(b)]
+	}
+	return rc
+}
+
+// Len returns the number of tags.
+func (taglib *TagLibrary) Len() int {
+	return len(taglib.tags)
+}
+
+// Tags returns the tag sequences, in tag ID order.
+func (taglib *TagLibrary) Tags() [][]byte {
+	return taglib.tags
+}
+
+var (
+	twobit = func() []tagmapKey {
+		r := make([]tagmapKey, 256)
+		r[int('a')] = 0
+		r[int('A')] = 0
+		r[int('c')] = 1
+		r[int('C')] = 1
+		r[int('g')] = 2
+		r[int('G')] = 2
+		r[int('t')] = 3
+		r[int('T')] = 3
+		return r
+	}()
+	complement = func() []byte {
+		r := make([]byte, 256)
+		for i := range r {
+			r[i] = byte(i)
+		}
+		for _, pair := range []string{"at", "cg", "AT", "CG"} {
+			r[int(pair[0])] = pair[1]
+			r[int(pair[1])] = pair[0]
+		}
+		return r
+	}()
+	isbase = func() []bool {
+		r := make([]bool, 256)
+		r[int('a')] = true
+		r[int('A')] = true
+		r[int('c')] = true
+		r[int('C')] = true
+		r[int('g')] = true
+		r[int('G')] = true
+		r[int('t')] = true
+		r[int('T')] = true
+		return r
+	}()
+)
+
+// SetTags builds the lookup tables for the given tags. Tags can have
+// any length, and do not all need to be the same length.
+//
+// An error is returned if a tag is empty or has bases other than
+// acgt, or if two tags are identical (ignoring case) or one is a
+// prefix of another, since FindAll would not be able to tell them
+// apart.
+func (taglib *TagLibrary) SetTags(tags [][]byte) error {
+	taglib.tags = tags
+	taglib.tables = nil
+	taglib.maxlen = 0
+	tables := map[int]*tagTable{}
+	for i, tag := range tags {
+		if len(tag) == 0 {
+			return fmt.Errorf("tag %d is empty", i)
+		}
+		for _, b := range tag {
+			if !isbase[int(b)] {
+				return fmt.Errorf("tag %d (%q) has non-acgt base %q", i, tag, b)
+			}
+		}
+		if taglib.maxlen < len(tag) {
+			taglib.maxlen = len(tag)
+		}
+		keylen := len(tag)
+		if keylen > tagmapKeySize {
+			keylen = tagmapKeySize
+		}
+		table := tables[keylen]
+		if table == nil {
+			table = &tagTable{
+				keylen:  keylen,
+				keymask: ^tagmapKey(0) >> uint(tagmapKeySize*2-keylen*2),
+				tagmap:  map[tagmapKey]tagInfo{},
+				more:    map[tagmapKey][]tagInfo{},
+			}
+			tables[keylen] = table
+			taglib.tables = append(taglib.tables, table)
+		}
+		key := tagKey(tag[:keylen])
+		other, ok := table.tagmap[key]
+		if !ok {
+			table.tagmap[key] = tagInfo{TagID(i), tag}
+			continue
+		} else if keylen < tagmapKeySize {
+			return fmt.Errorf("tag %d (%s) is the same as tag %d", i, tag, other.id)
+		}
+		// Both tags are at least tagmapKeySize long and
+		// start with the same tagmapKeySize bases.
+		for _, other := range append([]tagInfo{other}, table.more[key]...) {
+			if err := checkTagPrefix(tag, TagID(i), other); err != nil {
+				return err
+			}
+		}
+		table.more[key] = append(table.more[key], tagInfo{TagID(i), tag})
+	}
+	sort.Slice(taglib.tables, func(i, j int) bool {
+		return taglib.tables[i].keylen > taglib.tables[j].keylen
+	})
+	// A tag shorter than tagmapKeySize must not be a prefix of a
+	// longer tag.
+	for i, tag := range tags {
+		for _, table := range taglib.tables {
+			if table.keylen >= len(tag) || table.keylen == tagmapKeySize {
+				continue
+			}
+			if other, ok := table.tagmap[tagKey(tag[:table.keylen])]; ok {
+				if err := checkTagPrefix(tag, TagID(i), other); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func tagKey(seq []byte) tagmapKey {
+	var key tagmapKey
+	for _, b := range seq {
+		key = (key << 2) | twobit[int(b)]
+	}
+	return key
+}
+
+// checkTagPrefix returns an error if tag is the same as other.tagseq
+// or one is a prefix of the other.
+func checkTagPrefix(tag []byte, id TagID, other tagInfo) error {
+	a, b := tag, other.tagseq
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if !bytes.EqualFold(a, b[:len(a)]) {
+		return nil
+	} else if len(a) == len(b) {
+		return fmt.Errorf("tag %d (%s) is the same as tag %d", id, tag, other.id)
+	} else {
+		return fmt.Errorf("tag %d (%s) and tag %d (%s) cannot be distinguished: one is a prefix of the other", id, tag, other.id, other.tagseq)
+	}
+}
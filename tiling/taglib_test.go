@@ -0,0 +1,210 @@
+package tiling
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type taglibSuite struct{}
+
+var _ = check.Suite(&taglibSuite{})
+
+func (s *taglibSuite) TestFindAllTinyData(c *check.C) {
+	pr, pw, err := os.Pipe()
+	c.Assert(err, check.IsNil)
+	go func() {
+		defer pw.Close()
+		fmt.Fprintf(pw, `>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccac
+`)
+	}()
+	var taglib TagLibrary
+	err = taglib.Load(pr)
+	c.Assert(err, check.IsNil)
+	haystack := []byte(`ggagaactgtgctccgccttcagaccccccccccccccccccccacacatgctagcgcgtcggggtgggggggggggggggggggggggggggactctagcagagtggccagccac`)
+	var matches []tagMatch
+	taglib.FindAll(haystack, func(id TagID, pos, taglen int, rev bool) {
+		matches = append(matches, tagMatch{id, pos, taglen, rev})
+	})
+	c.Check(matches, check.DeepEquals, []tagMatch{{0, 0, 24, false}, {1, 44, 24, false}, {2, 92, 24, false}})
+}
+
+func (s *taglibSuite) TestFindAllReverseComplement(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	// tag 1 reverse-complemented, tag 0 forward, tag 2
+	// reverse-complemented
+	haystack := []byte(`ccaccccgacgcgctagcatgtgtccccggagaactgtgctccgccttcagaccccgtggctggccactctgctagagtc`)
+	var matches []tagMatch
+	taglib.FindAll(haystack, func(id TagID, pos, taglen int, rev bool) {
+		matches = append(matches, tagMatch{id, pos, taglen, rev})
+	})
+	c.Check(matches, check.DeepEquals, []tagMatch{{1, 0, 24, true}, {0, 28, 24, false}, {2, 56, 24, true}})
+	for _, m := range matches {
+		if m.rev {
+			c.Check(string(ReverseComplement(haystack[m.pos:m.pos+m.taglen])), check.Equals, string(taglib.Tags()[m.id]))
+		}
+	}
+}
+
+func (s *taglibSuite) TestFindAllRealisticSize(c *check.C) {
+	start := time.Now()
+	acgt := []byte{'a', 'c', 'g', 't'}
+	haystack := make([]byte, 25000000) // ~1/2 smallest human chromosome
+	c.Logf("@%v haystack", time.Since(start))
+	rand.Read(haystack)
+	for i := range haystack {
+		haystack[i] = acgt[int(haystack[i]&3)]
+	}
+
+	tagcount := 12500
+	tagsize := 24
+	var tags []string
+	pr, pw := io.Pipe()
+	go func() {
+		defer pw.Close()
+		w := bufio.NewWriter(pw)
+		defer w.Flush()
+		used := map[string]bool{}
+		fmt.Fprint(w, ">000\n")
+		for i := 0; len(tags) < tagcount; i += (len(haystack) - tagsize) / tagcount {
+			i := i
+			tag := haystack[i : i+tagsize]
+			for used[string(tag)] {
+				i++
+				tag = haystack[i : i+tagsize]
+			}
+			used[string(tag)] = true
+			tags = append(tags, strings.ToLower(string(tag)))
+			w.Write(tag)
+			w.Write([]byte{'\n'})
+		}
+	}()
+	c.Logf("@%v build library", time.Since(start))
+	var taglib TagLibrary
+	err := taglib.Load(pr)
+	c.Assert(err, check.IsNil)
+	c.Logf("@%v find tags in input", time.Since(start))
+	var matches []tagMatch
+	taglib.FindAll(haystack, func(id TagID, pos, taglen int, rev bool) {
+		matches = append(matches, tagMatch{id, pos, taglen, rev})
+	})
+	c.Logf("@%v done", time.Since(start))
+	c.Check(matches[0], check.Equals, tagMatch{0, 0, tagsize, false})
+	c.Check(matches[1].id, check.Equals, TagID(1))
+}
+
+func (s *taglibSuite) TestFindAllMixedLengths(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgcctt
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccacgtaccttgcaattgcatgc
+gactctagcagagtggccagccacgtaccttgcaattgaaaaa
+`))
+	c.Assert(err, check.IsNil)
+	long := "gactctagcagagtggccagccacgtaccttgcaattgaaaaa"
+	haystack := []byte(`ggagaactgtgctccgccttcccccacacatgctagcgcgtcggggtggccccc` + long + `cccccgactctagcagagtggccagccacgtaccttgcaattgttttt` + string(ReverseComplement([]byte(long))))
+	var matches []tagMatch
+	taglib.FindAll(haystack, func(id TagID, pos, taglen int, rev bool) {
+		matches = append(matches, tagMatch{id, pos, taglen, rev})
+	})
+	// The second-to-last sequence shares its first 38 bases with
+	// tags 2 and 3, but doesn't match either one.
+	c.Check(matches, check.DeepEquals, []tagMatch{{0, 0, 20, false}, {1, 25, 24, false}, {3, 54, 43, false}, {3, 145, 43, true}})
+}
+
+func (s *taglibSuite) TestTagCollisions(c *check.C) {
+	for _, trial := range []struct {
+		tags string
+		err  string
+	}{
+		{"acgtacgt\nggccggcc\n", ""},
+		{"acgtacgt\nACGTACGT\n", `tag 1 .* is the same as tag 0`},
+		{"acgtacgt\nacgtacgtaa\n", `.*one is a prefix of the other`},
+		{"acgtacgtaa\nacgtacgt\n", `.*one is a prefix of the other`},
+		{"gactctagcagagtggccagccacgtaccttgca\ngactctagcagagtggccagccacgtaccttgcaattg\n", `.*one is a prefix of the other`},
+		{"gactctagcagagtggccagccacgtaccttgcaattg\ngactctagcagagtggccagccacgtaccttgcaattg\n", `tag 1 .* is the same as tag 0`},
+		{"acgtnacgt\n", `tag 0 .* has non-acgt base 'n'`},
+	} {
+		var taglib TagLibrary
+		err := taglib.Load(bytes.NewBufferString(">0\n" + trial.tags))
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err, check.Commentf("%q", trial.tags))
+		}
+	}
+}
+
+func (s *taglibSuite) TestScanParallel(c *check.C) {
+	defer func(n int) { minScanPiece = n }(minScanPiece)
+	minScanPiece = 50
+
+	rnd := rand.New(rand.NewSource(1))
+	randomSeq := func(n int) []byte {
+		seq := make([]byte, n)
+		for i := range seq {
+			seq[i] = "acgt"[rnd.Intn(4)]
+		}
+		return seq
+	}
+	// Short tags match often enough that tag occurrences overlap,
+	// so the tags found near the start of each piece depend on
+	// where the scan started.
+	var tags [][]byte
+	for i := 0; i < 20; i++ {
+		tags = append(tags, randomSeq(6))
+	}
+	var haystack []byte
+	for i := 0; i < 4000; i++ {
+		haystack = append(haystack, randomSeq(rnd.Intn(10))...)
+		switch i % 5 {
+		case 0:
+			haystack = append(haystack, tags[rnd.Intn(len(tags))]...)
+		case 1:
+			haystack = append(haystack, ReverseComplement(tags[rnd.Intn(len(tags))])...)
+		case 2:
+			haystack = append(haystack, 'n')
+		}
+	}
+	long := randomSeq(40)
+	tags = append(tags, long)
+	haystack = append(haystack, long...)
+	haystack = append(long, haystack...)
+	var taglib TagLibrary
+	err := taglib.SetTags(tags)
+	c.Assert(err, check.IsNil)
+
+	var expect []tagMatch
+	taglib.FindAll(haystack, func(id TagID, pos, taglen int, rev bool) {
+		expect = append(expect, tagMatch{id, pos, taglen, rev})
+	})
+	c.Logf("found %d tags", len(expect))
+	for threads := 1; threads < 20; threads++ {
+		var matches []tagMatch
+		finder := tagFinder{taglib: &taglib}
+		finder.scanParallel(haystack, 0, len(haystack), threads, func(id TagID, pos, taglen int, rev bool) {
+			matches = append(matches, tagMatch{id, pos, taglen, rev})
+		})
+		c.Check(matches, check.DeepEquals, expect, check.Commentf("threads=%d", threads))
+	}
+}
@@ -0,0 +1,265 @@
+package tiling
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// TileVariantID was uint16 in older versions. Gob encodes all
+// unsigned integer types the same way, so libraries written by older
+// versions can still be read.
+type TileVariantID uint32 // 1-based
+
+// TileLibRef identifies a tile variant. Variant 0 means the tile
+// could not be identified because its sequence has no-calls (see
+// TileLibrary.KeepPartial).
+type TileLibRef struct {
+	Tag     TagID
+	Variant TileVariantID
+
+	// Span is the number of tags covered by the tile in a tile
+	// path: 1 if the tile ends at the next tag, or N if it ends
+	// at tag Tag+N because the tags in between were skipped or
+	// missing. It is zero if the TileLibRef only identifies a
+	// variant (e.g., the result of GetRef).
+	Span int
+}
+
+// TileSeq maps sequence labels (e.g., chromosome names) to tile
+// paths.
+type TileSeq map[string][]TileLibRef
+
+// Variants returns a flat list of tiles, indexed by tag, along with
+// the number of tags found exactly once and the number of additional
+// (repeated) occurrences, which are dropped. Tags that were not found
+// have variant 0 and span 0.
+func (tseq TileSeq) Variants() ([]TileLibRef, int, int) {
+	maxtag := 0
+	for _, refs := range tseq {
+		for _, ref := range refs {
+			if maxtag < int(ref.Tag) {
+				maxtag = int(ref.Tag)
+			}
+		}
+	}
+	vars := make([]TileLibRef, maxtag+1)
+	var kept, dropped int
+	for _, refs := range tseq {
+		for _, ref := range refs {
+			if vars[int(ref.Tag)].Span != 0 {
+				dropped++
+			} else {
+				kept++
+			}
+			vars[int(ref.Tag)] = ref
+		}
+	}
+	return vars, kept, dropped
+}
+
+// TileLibrary assigns variant IDs to tile sequences. It is safe for
+// concurrent use.
+type TileLibrary struct {
+	// If non-nil, NewVariant is called for each tile variant
+	// added by GetRef, before GetRef returns. Calls are
+	// serialized, so (for example) a caller that writes each
+	// new variant to a stream can be sure the variant is written
+	// before anything that refers to it.
+	NewVariant func(tag TagID, variant TileVariantID, hash [blake2b.Size256]byte, seq []byte) error
+
+	// Assign variant IDs to partial tiles, i.e., tiles with some
+	// no-calls (bases other than acgt), instead of returning
+	// variant 0. Partial tiles are numbered in the same ID space
+	// as fully called tiles; NoCalls can be used to tell them
+	// apart.
+	KeepPartial bool
+
+	ntags int
+	init  sync.Once
+	// variant[tag][i] is the hash of variant i+1 of tag
+	variant [][][blake2b.Size256]byte
+	// index[tag] maps hashes to variant IDs, if tag has at least
+	// indexThreshold variants
+	index    []map[[blake2b.Size256]byte]TileVariantID
+	variants int64 // total, updated atomically
+	// locks[tag%len(locks)] protects variant[tag] and index[tag]
+	locks         [256]sync.Mutex
+	newVariantMtx sync.Mutex
+}
+
+// indexThreshold is the number of variants a tag needs before
+// TileLibrary maintains a hash index for it. Below this, a linear
+// search is faster.
+var indexThreshold = 16
+
+// NewTileLibrary returns an empty tile library for a tag set with
+// the given number of tags.
+func NewTileLibrary(ntags int) *TileLibrary {
+	return &TileLibrary{ntags: ntags}
+}
+
+// lock allocates the per-tag data structures if needed, locks the
+// given tag, and returns the corresponding unlock func.
+func (tilelib *TileLibrary) lock(tag TagID) func() {
+	tilelib.init.Do(func() {
+		tilelib.variant = make([][][blake2b.Size256]byte, tilelib.ntags)
+		tilelib.index = make([]map[[blake2b.Size256]byte]TileVariantID, tilelib.ntags)
+	})
+	mtx := &tilelib.locks[int(tag)%len(tilelib.locks)]
+	mtx.Lock()
+	return mtx.Unlock
+}
+
+// AddKnownVariant adds a tile variant with an already-assigned
+// variant ID (e.g., from an existing library) without calling
+// NewVariant. Subsequent calls to GetRef will return the given
+// variant ID for a tile with the same hash, and will number new
+// variants after the highest known variant ID for the tag.
+func (tilelib *TileLibrary) AddKnownVariant(tag TagID, variant TileVariantID, hash [blake2b.Size256]byte) error {
+	if int(tag) >= tilelib.ntags {
+		return fmt.Errorf("tile variant has tag %d, but tag library only has %d tags", tag, tilelib.ntags)
+	} else if variant == 0 {
+		return fmt.Errorf("invalid tile variant: tag %d variant 0", tag)
+	}
+	defer tilelib.lock(tag)()
+	vars := tilelib.variant[tag]
+	for len(vars) < int(variant) {
+		vars = append(vars, [blake2b.Size256]byte{})
+	}
+	if vars[variant-1] != ([blake2b.Size256]byte{}) {
+		return fmt.Errorf("duplicate tile variant: tag %d variant %d", tag, variant)
+	}
+	vars[variant-1] = hash
+	tilelib.variant[tag] = vars
+	tilelib.indexVariant(tag, variant)
+	atomic.AddInt64(&tilelib.variants, 1)
+	return nil
+}
+
+// indexVariant adds the given variant to the tag's hash index,
+// creating the index if the tag now has enough variants. The caller
+// must hold the tag's lock.
+func (tilelib *TileLibrary) indexVariant(tag TagID, variant TileVariantID) {
+	vars := tilelib.variant[tag]
+	if idx := tilelib.index[tag]; idx != nil {
+		idx[vars[variant-1]] = variant
+		return
+	} else if len(vars) < indexThreshold {
+		return
+	}
+	idx := make(map[[blake2b.Size256]byte]TileVariantID, len(vars))
+	for i, hash := range vars {
+		if hash != ([blake2b.Size256]byte{}) {
+			idx[hash] = TileVariantID(i + 1)
+		}
+	}
+	tilelib.index[tag] = idx
+}
+
+// Len returns the total number of tile variants in the library.
+func (tilelib *TileLibrary) Len() int {
+	return int(atomic.LoadInt64(&tilelib.variants))
+}
+
+// GetRef returns a TileLibRef for a tile with the given tag and
+// sequence, adding the sequence to the library if needed.
+//
+// If seq has any bases other than acgt (lower case) and KeepPartial
+// is false, the returned TileLibRef has variant 0, and the library is
+// not changed.
+func (tilelib *TileLibrary) GetRef(tag TagID, seq []byte) (TileLibRef, error) {
+	if tilelib.missing(seq) {
+		return TileLibRef{Tag: tag}, nil
+	}
+	return tilelib.getRef(tag, seq, blake2b.Sum256(seq))
+}
+
+// missing returns true if GetRef would treat seq as a missing tile,
+// i.e., seq has no-calls and KeepPartial is false.
+func (tilelib *TileLibrary) missing(seq []byte) bool {
+	if tilelib.KeepPartial {
+		return false
+	}
+	for _, b := range seq {
+		if !called[b] {
+			return true
+		}
+	}
+	return false
+}
+
+// called[b] is true if b is a lower case base (acgt).
+var called = func() (r [256]bool) {
+	for _, b := range []byte("acgt") {
+		r[b] = true
+	}
+	return
+}()
+
+// getRef is GetRef for a tile that is not missing and whose hash has
+// already been computed.
+//
+// Only the given tag is locked, so lookups for different tags can
+// proceed concurrently. NewVariant is called with the tag still
+// locked, so no other caller can get the new variant ID before
+// NewVariant returns.
+func (tilelib *TileLibrary) getRef(tag TagID, seq []byte, seqhash [blake2b.Size256]byte) (TileLibRef, error) {
+	if int(tag) >= tilelib.ntags {
+		return TileLibRef{}, fmt.Errorf("tile has tag %d, but tag library only has %d tags", tag, tilelib.ntags)
+	}
+	defer tilelib.lock(tag)()
+	if idx := tilelib.index[tag]; idx != nil {
+		if variant, ok := idx[seqhash]; ok {
+			return TileLibRef{Tag: tag, Variant: variant}, nil
+		}
+	} else {
+		for i, varhash := range tilelib.variant[tag] {
+			if varhash == seqhash {
+				return TileLibRef{Tag: tag, Variant: TileVariantID(i + 1)}, nil
+			}
+		}
+	}
+	if uint64(len(tilelib.variant[tag])) >= math.MaxUint32 {
+		return TileLibRef{}, fmt.Errorf("cannot add tile variant: tag %d already has %d variants", tag, len(tilelib.variant[tag]))
+	}
+	tilelib.variant[tag] = append(tilelib.variant[tag], seqhash)
+	variant := TileVariantID(len(tilelib.variant[tag]))
+	tilelib.indexVariant(tag, variant)
+	atomic.AddInt64(&tilelib.variants, 1)
+	if tilelib.NewVariant != nil {
+		tilelib.newVariantMtx.Lock()
+		err := tilelib.NewVariant(tag, variant, seqhash, seq)
+		tilelib.newVariantMtx.Unlock()
+		if err != nil {
+			return TileLibRef{}, err
+		}
+	}
+	return TileLibRef{Tag: tag, Variant: variant}, nil
+}
+
+// NoCallRange is a range of no-call positions in a tile sequence,
+// from Start (inclusive) to End (exclusive).
+type NoCallRange struct {
+	Start int
+	End   int
+}
+
+// NoCalls returns the ranges of positions in seq with bases other
+// than acgt (lower case), or nil if seq is fully called.
+func NoCalls(seq []byte) []NoCallRange {
+	var ranges []NoCallRange
+	for i, b := range seq {
+		if called[b] {
+			continue
+		} else if n := len(ranges); n > 0 && ranges[n-1].End == i {
+			ranges[n-1].End++
+		} else {
+			ranges = append(ranges, NoCallRange{Start: i, End: i + 1})
+		}
+	}
+	return ranges
+}
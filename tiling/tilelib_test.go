@@ -0,0 +1,117 @@
+package tiling
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"gopkg.in/check.v1"
+)
+
+type tilelibSuite struct{}
+
+var _ = check.Suite(&tilelibSuite{})
+
+// benchTiles returns tiles resembling an import workload: most tags
+// have a few variants, and some common tags have hundreds.
+func benchTiles(ntags int) (tags []TagID, seqs [][]byte) {
+	rnd := rand.New(rand.NewSource(1))
+	for tag := 0; tag < ntags; tag++ {
+		nvariants := 1 + rnd.Intn(4)
+		if tag%100 == 0 {
+			nvariants = 500
+		}
+		base := make([]byte, 250)
+		for i := range base {
+			base[i] = "acgt"[rnd.Intn(4)]
+		}
+		for v := 0; v < nvariants; v++ {
+			seq := append([]byte(nil), base...)
+			seq[rnd.Intn(len(seq))] = "acgt"[v%4]
+			seq[rnd.Intn(len(seq))] = "acgt"[v/4%4]
+			seq[rnd.Intn(len(seq))] = "acgt"[v/16%4]
+			tags = append(tags, TagID(tag))
+			seqs = append(seqs, seq)
+		}
+	}
+	rnd.Shuffle(len(tags), func(i, j int) {
+		tags[i], tags[j] = tags[j], tags[i]
+		seqs[i], seqs[j] = seqs[j], seqs[i]
+	})
+	return
+}
+
+func (s *tilelibSuite) TestGetRefConcurrent(c *check.C) {
+	tags, seqs := benchTiles(1000)
+	tilelib := NewTileLibrary(1000)
+	var mtx sync.Mutex
+	busy := false
+	added := map[TileLibRef][blake2b.Size256]byte{}
+	tilelib.NewVariant = func(tag TagID, variant TileVariantID, hash [blake2b.Size256]byte, seq []byte) error {
+		mtx.Lock()
+		c.Check(busy, check.Equals, false)
+		busy = true
+		mtx.Unlock()
+		c.Check(hash, check.Equals, blake2b.Sum256(seq))
+		mtx.Lock()
+		ref := TileLibRef{Tag: tag, Variant: variant}
+		_, dup := added[ref]
+		c.Check(dup, check.Equals, false)
+		added[ref] = hash
+		busy = false
+		mtx.Unlock()
+		return nil
+	}
+	refs := make([][]TileLibRef, 4)
+	var wg sync.WaitGroup
+	for t := range refs {
+		t := t
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range seqs {
+				// each goroutine looks up the tiles in a
+				// different order
+				i := (i + t*len(seqs)/len(refs)) % len(seqs)
+				ref, err := tilelib.GetRef(tags[i], seqs[i])
+				c.Check(err, check.IsNil)
+				refs[t] = append(refs[t], ref)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Check(tilelib.Len(), check.Equals, len(added))
+	for t := range refs {
+		for j, ref := range refs[t] {
+			i := (j + t*len(seqs)/len(refs)) % len(seqs)
+			c.Check(added[ref], check.Equals, blake2b.Sum256(seqs[i]))
+		}
+	}
+}
+
+// BenchmarkGetRef looks up tiles from runtime.NumCPU() goroutines,
+// like import does. Run with "go test -check.b".
+func (s *tilelibSuite) BenchmarkGetRef(c *check.C) {
+	tags, seqs := benchTiles(20000)
+	tilelib := NewTileLibrary(20000)
+	for i := range seqs {
+		tilelib.GetRef(tags[i], seqs[i])
+	}
+	c.SetBytes(int64(len(seqs[0])))
+	c.ResetTimer()
+	nthreads := runtime.NumCPU()
+	var wg sync.WaitGroup
+	for t := 0; t < nthreads; t++ {
+		t := t
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := t; n < c.N; n += nthreads {
+				i := n % len(seqs)
+				tilelib.GetRef(tags[i], seqs[i])
+			}
+		}()
+	}
+	wg.Wait()
+}
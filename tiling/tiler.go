@@ -0,0 +1,535 @@
+package tiling
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"runtime"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Tiler splits sequences into tiles at the locations of tags, and
+// looks up (or adds) each tile in a tile library.
+//
+// Each tile starts with a tag and ends with the next tag found in
+// the sequence (or the end of the sequence), so consecutive tiles
+// overlap by one tag.
+type Tiler struct {
+	TagLibrary  *TagLibrary
+	TileLibrary *TileLibrary
+
+	// Skip tags that appear out of order (i.e., where a tag with
+	// a higher ID appears before a tag with a lower ID).
+	SkipOOO bool
+
+	// If Include is non-nil, TileFasta skips sequences whose
+	// labels do not match it.
+	Include *regexp.Regexp
+
+	// If Exclude is non-nil, TileFasta skips sequences whose
+	// labels match it.
+	Exclude *regexp.Regexp
+
+	// Number of goroutines to use for finding tags and hashing
+	// tiles within a single sequence. If less than 2, each
+	// sequence is tiled in a single goroutine. The results are
+	// the same either way.
+	Threads int
+}
+
+// DefaultExclude matches sequence labels with "_" (e.g., unplaced
+// and alt contigs).
+var DefaultExclude = regexp.MustCompile(`_`)
+
+// NewTiler returns a Tiler that uses the given tag library and a new
+// (empty) tile library, excludes sequences that match
+// DefaultExclude, and uses one thread per CPU.
+func NewTiler(taglib *TagLibrary) *Tiler {
+	return &Tiler{
+		TagLibrary:  taglib,
+		TileLibrary: NewTileLibrary(taglib.Len()),
+		Exclude:     DefaultExclude,
+		Threads:     runtime.NumCPU(),
+	}
+}
+
+type foundTag struct {
+	pos    int
+	tagid  TagID
+	taglen int
+	rev    bool
+}
+
+// TagPosition is the location of a tag in a (reference) sequence.
+type TagPosition struct {
+	Tag   TagID
+	Chrom string // sequence label
+	Start int    // 0-based
+	End   int    // exclusive
+}
+
+// strandDecisionTags is the number of tags, from the start of a
+// sequence, used to decide whether the sequence is on the forward
+// strand or needs to be reverse-complemented (see reverseStrand). It
+// also determines how much of a sequence TileFasta reads before it
+// can start tiling.
+var strandDecisionTags = 1000
+
+// readChunkSize is the amount of sequence data TileFasta reads at a
+// time.
+var readChunkSize = 1 << 20
+
+// minHashBatch is the smallest number of tiles appendRef hashes in
+// each goroutine.
+var minHashBatch = 64
+
+// tile is a tile found in a sequence.
+type tile struct {
+	tag  foundTag // tag at the start of the tile
+	span int      // number of tags spanned (see TileLibRef)
+	seq  []byte
+}
+
+// tileFunc is called with the tiles found in a sequence, in order. It
+// can be called more than once per sequence. The tile sequences are
+// only valid until it returns.
+type tileFunc func(tiles []tile) error
+
+// Tile returns the tile path for the given sequence. If most of the
+// first strandDecisionTags tags in seq are on the reverse strand, the
+// reverse complement of seq is tiled instead.
+func (tiler *Tiler) Tile(seq []byte) ([]TileLibRef, error) {
+	var path []TileLibRef
+	_, _, _, err := tiler.tileSeq("", bytes.ToLower(seq), nil, tiler.appendRef(&path))
+	return path, err
+}
+
+// appendRef returns a tileFunc that looks up each tile in the tile
+// library and appends it to *path.
+//
+// The tiles are hashed concurrently, but looked up in order, so new
+// variant IDs are assigned in the same order as with GetRef.
+func (tiler *Tiler) appendRef(path *[]TileLibRef) tileFunc {
+	tilelib := tiler.TileLibrary
+	return func(tiles []tile) error {
+		hashes := make([][blake2b.Size256]byte, len(tiles))
+		missing := make([]bool, len(tiles))
+		nthreads := tiler.Threads
+		if nthreads > len(tiles)/minHashBatch {
+			nthreads = len(tiles) / minHashBatch
+		}
+		if nthreads < 1 {
+			nthreads = 1
+		}
+		var wg sync.WaitGroup
+		for t := 0; t < nthreads; t++ {
+			t := t
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := len(tiles) * t / nthreads; i < len(tiles)*(t+1)/nthreads; i++ {
+					missing[i] = tilelib.missing(tiles[i].seq)
+					if !missing[i] {
+						hashes[i] = blake2b.Sum256(tiles[i].seq)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		for i, t := range tiles {
+			ref := TileLibRef{Tag: t.tag.tagid}
+			if !missing[i] {
+				var err error
+				ref, err = tilelib.getRef(t.tag.tagid, t.seq, hashes[i])
+				if err != nil {
+					return err
+				}
+			}
+			ref.Span = t.span
+			*path = append(*path, ref)
+		}
+		return nil
+	}
+}
+
+// TileFasta returns the tile paths for all of the sequences in a
+// fasta file, keyed by sequence label. Sequences whose labels are not
+// selected by Include and Exclude are skipped. The filelabel is used
+// in log messages.
+//
+// Sequences on the forward strand are tiled as they are read, so
+// they do not need to fit in memory; see strandDecisionTags.
+func (tiler *Tiler) TileFasta(filelabel string, rdr io.Reader) (TileSeq, error) {
+	ret := TileSeq{}
+	totalPathLen := 0
+	totalSkipped := 0
+	reversedSequences := 0
+	skippedInclude, skippedExclude, err := tiler.readFasta(filelabel, rdr, func(label string, seq io.Reader) error {
+		log.Debugf("%s %s tiling", filelabel, label)
+		var path []TileLibRef
+		seqlen, reversed, skipped, err := tiler.tileReader(filelabel+" "+label, seq, tiler.appendRef(&path))
+		if err != nil {
+			return err
+		} else if seqlen == 0 {
+			return nil
+		}
+		if reversed {
+			reversedSequences++
+		}
+		totalSkipped += skipped
+		ret[label] = path
+		log.Debugf("%s %s tiled with path len %d, skipped %d", filelabel, label, len(path), skipped)
+		totalPathLen += len(path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s tiled with total path len %d in %d sequences (reverse-complemented %d sequences, skipped %d sequences not matching include pattern, skipped %d sequences matching exclude pattern, skipped %d out-of-order tags)", filelabel, totalPathLen, len(ret), reversedSequences, skippedInclude, skippedExclude, totalSkipped)
+	return ret, nil
+}
+
+// LocateFasta returns the positions of the tags that would be used
+// to tile the sequences in a fasta file (typically a reference
+// genome), in the order they appear. Positions are given on the
+// forward strand of the input, even if a sequence would be
+// reverse-complemented for tiling. A tag can appear more than once.
+//
+// The tile library is not used or changed.
+func (tiler *Tiler) LocateFasta(filelabel string, rdr io.Reader) ([]TagPosition, error) {
+	var ret []TagPosition
+	_, _, err := tiler.readFasta(filelabel, rdr, func(label string, seq io.Reader) error {
+		log.Debugf("%s %s finding tags", filelabel, label)
+		var tps []TagPosition
+		seqlen, reversed, _, err := tiler.tileReader(filelabel+" "+label, seq, func(tiles []tile) error {
+			for _, t := range tiles {
+				tps = append(tps, TagPosition{Tag: t.tag.tagid, Chrom: label, Start: t.tag.pos, End: t.tag.pos + t.tag.taglen})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if reversed {
+			for i := range tps {
+				tps[i].Start, tps[i].End = seqlen-tps[i].End, seqlen-tps[i].Start
+			}
+		}
+		ret = append(ret, tps...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s found %d tags", filelabel, len(ret))
+	return ret, nil
+}
+
+// readFasta calls fn with the label and sequence of each record in a
+// fasta file that is selected by Include and Exclude, and returns the
+// number of records skipped because of each.
+func (tiler *Tiler) readFasta(filelabel string, rdr io.Reader, fn func(label string, seq io.Reader) error) (skippedInclude, skippedExclude int, err error) {
+	fr := NewFastaReader(rdr)
+	for {
+		var label string
+		label, err = fr.Next()
+		if err == io.EOF {
+			return skippedInclude, skippedExclude, nil
+		} else if err != nil {
+			return
+		}
+		if tiler.Include != nil && !tiler.Include.MatchString(label) {
+			log.Printf("%s %s skipped: label does not match include pattern %q", filelabel, label, tiler.Include)
+			skippedInclude++
+			continue
+		} else if tiler.Exclude != nil && tiler.Exclude.MatchString(label) {
+			log.Printf("%s %s skipped: label matches exclude pattern %q", filelabel, label, tiler.Exclude)
+			skippedExclude++
+			continue
+		}
+		log.Debugf("%s %s reading fasta", filelabel, label)
+		err = fn(label, fr)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// tileReader reads a sequence from rdr and calls fn for each tile.
+// It returns the length of the sequence, whether it was
+// reverse-complemented, and the number of out-of-order tags skipped.
+//
+// If the first strandDecisionTags tags found are not mostly on the
+// reverse strand, tiles are passed to fn as soon as they are read, and
+// only the current tile and a small amount of lookahead are kept in
+// memory. Otherwise, the whole sequence is read before tiling, as in
+// tileSeq.
+func (tiler *Tiler) tileReader(label string, rdr io.Reader, fn tileFunc) (seqlen int, reversed bool, skipped int, err error) {
+	finder := tagFinder{taglib: tiler.TagLibrary}
+	var buf []byte // sequence data, starting at offset base
+	base := 0
+	scanned := 0         // offset of the next base to scan
+	var found []foundTag // tags found but not yet tiled
+	fwdOnly := false     // strand has been decided, ignore reverse tags
+	eof := false
+	read := func() error {
+		if cap(buf)-len(buf) < readChunkSize {
+			buf = append(buf, make([]byte, readChunkSize)...)[:len(buf)]
+		}
+		n, err := rdr.Read(buf[len(buf):cap(buf)])
+		lower(buf[len(buf) : len(buf)+n])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+		return err
+	}
+	scan := func() {
+		end := base + len(buf)
+		if !eof {
+			end -= finder.lookahead()
+		}
+		if end <= scanned {
+			return
+		}
+		finder.scanParallel(buf, scanned-base, end-base, tiler.Threads, func(tagid TagID, pos, taglen int, rev bool) {
+			if rev && fwdOnly {
+				return
+			}
+			found = append(found, foundTag{pos: base + pos, tagid: tagid, taglen: taglen, rev: rev})
+		})
+		scanned = end
+	}
+
+	for !eof && len(found) < strandDecisionTags {
+		if err = read(); err != nil {
+			return
+		}
+		scan()
+	}
+	if eof || reverseStrand(found) {
+		// Short sequence, or (probably) reverse strand: read
+		// the whole thing and tile it in memory.
+		for !eof {
+			if err = read(); err != nil {
+				return
+			}
+		}
+		_, reversed, skipped, err = tiler.tileSeq(label, buf, found[:0], fn)
+		return len(buf), reversed, skipped, err
+	}
+
+	log.Debugf("%s found %d tags, mostly on forward strand, tiling while reading", label, len(found))
+	fwd := found[:0]
+	for _, f := range found {
+		if !f.rev {
+			fwd = append(fwd, f)
+		}
+	}
+	found = fwd
+	fwdOnly = true
+	last := foundTag{tagid: -1}
+	var tiles []tile
+	for {
+		// Tile as far as possible with the tags found so far.
+		// Unless we have reached the end of the sequence, we
+		// need to know the tag after f in order to decide
+		// whether to skip f.
+		for len(found) > 0 && (eof || len(found) > 1) {
+			f := found[0]
+			var next *foundTag
+			if len(found) > 1 {
+				next = &found[1]
+			}
+			found = found[1:]
+			if tiler.SkipOOO && tiler.outOfOrder(label, f, last, next) {
+				skipped++
+				continue
+			}
+			if last.taglen > 0 {
+				tiles = append(tiles, tile{last, tileSpan(last, f), buf[last.pos-base : f.pos+f.taglen-base]})
+			}
+			last = f
+		}
+		if eof {
+			break
+		}
+		if err = fn(tiles); err != nil {
+			return
+		}
+		tiles = tiles[:0]
+
+		// Discard data we no longer need, i.e., everything
+		// before the current tile, the next found tag, and
+		// the lookbehind needed by the finder.
+		keep := scanned - finder.lookbehind()
+		if last.taglen > 0 && keep > last.pos {
+			keep = last.pos
+		}
+		if len(found) > 0 && keep > found[0].pos {
+			keep = found[0].pos
+		}
+		if keep-base > len(buf)/2 {
+			buf = buf[:copy(buf, buf[keep-base:])]
+			base = keep
+		}
+
+		if err = read(); err != nil {
+			return
+		}
+		// Read enough to keep all threads busy scanning.
+		for !eof && base+len(buf)-scanned < tiler.Threads*readChunkSize {
+			if err = read(); err != nil {
+				return
+			}
+		}
+		scan()
+	}
+	seqlen = base + len(buf)
+	if last.taglen > 0 {
+		tiles = append(tiles, tile{last, 1, buf[last.pos-base:]})
+	}
+	err = fn(tiles)
+	return
+}
+
+// tileSeq calls fn for each tile in seq (which must be lower case),
+// using found as a buffer for the tags found in seq. It returns the
+// updated found slice, whether seq was reverse-complemented, and the
+// number of out-of-order tags skipped.
+func (tiler *Tiler) tileSeq(label string, seq []byte, found []foundTag, fn tileFunc) ([]foundTag, bool, int, error) {
+	seq, found, reversed, skipped := tiler.findTags(label, seq, found)
+	tiles := make([]tile, len(found))
+	for i, f := range found {
+		end, span := len(seq), 1
+		if i+1 < len(found) {
+			end, span = found[i+1].pos+found[i+1].taglen, tileSpan(f, found[i+1])
+		}
+		tiles[i] = tile{f, span, seq[f.pos:end]}
+	}
+	if err := fn(tiles); err != nil {
+		return nil, false, 0, err
+	}
+	return found, reversed, skipped, nil
+}
+
+// tileSpan returns the number of tags spanned by a tile that starts
+// with tag f and ends with tag next.
+func tileSpan(f, next foundTag) int {
+	if next.tagid > f.tagid {
+		return int(next.tagid - f.tagid)
+	}
+	return 1
+}
+
+// findTags replaces the contents of found with the tags in seq
+// (which must be lower case) that should be used for tiling, in the
+// order they appear. If reverseStrand(found) is true, the
+// positions are given in the reverse complement of seq, which is
+// returned along with reversed=true. It also returns the number of
+// out-of-order tags skipped.
+func (tiler *Tiler) findTags(label string, seq []byte, found []foundTag) (_ []byte, _ []foundTag, reversed bool, skipped int) {
+	tiler.findAll(seq, func(tagid TagID, pos, taglen int, rev bool) {
+		found = append(found, foundTag{pos: pos, tagid: tagid, taglen: taglen, rev: rev})
+	})
+	reversed = reverseStrand(found)
+	if reversed {
+		// Most tags are on the reverse strand, so tile the
+		// reverse complement instead. This way the tile
+		// variants are the same as they would be for the same
+		// sequence on the forward strand.
+		log.Debugf("%s found %d tags, mostly on reverse strand, tiling reverse complement", label, len(found))
+		seq = ReverseComplement(seq)
+		found = found[:0]
+		tiler.findAll(seq, func(tagid TagID, pos, taglen int, rev bool) {
+			found = append(found, foundTag{pos: pos, tagid: tagid, taglen: taglen, rev: rev})
+		})
+	}
+	// Ignore tags found on the other strand.
+	fwd := found[:0]
+	for _, f := range found {
+		if !f.rev {
+			fwd = append(fwd, f)
+		}
+	}
+	found = fwd
+
+	if !tiler.SkipOOO {
+		return seq, found, reversed, 0
+	}
+	// Remove out-of-order tags. This is done in place, which is
+	// safe because each append to keep overwrites an element of
+	// found that has already been examined.
+	keep := found[:0]
+	last := foundTag{tagid: -1}
+	for i, f := range found {
+		log.Tracef("%s found[%d] == %#v", label, i, f)
+		var next *foundTag
+		if i+1 < len(found) {
+			next = &found[i+1]
+		}
+		if tiler.outOfOrder(label, f, last, next) {
+			continue
+		}
+		keep = append(keep, f)
+		last = f
+	}
+	return seq, keep, reversed, len(found) - len(keep)
+}
+
+// reverseStrand returns true if most of the first
+// strandDecisionTags tags in found are on the reverse strand.
+//
+// Only the first tags are considered, even when the whole sequence
+// is available (as in Tile), so that a sequence is tiled the same
+// way whether or not TileFasta can stream it.
+func reverseStrand(found []foundTag) bool {
+	if len(found) > strandDecisionTags {
+		found = found[:strandDecisionTags]
+	}
+	nrev := 0
+	for _, f := range found {
+		if f.rev {
+			nrev++
+		}
+	}
+	return nrev*2 > len(found)
+}
+
+// findAll is like TagLibrary.FindAll, but uses tiler.Threads
+// goroutines.
+func (tiler *Tiler) findAll(seq []byte, fn func(id TagID, pos, taglen int, rev bool)) {
+	finder := tagFinder{taglib: tiler.TagLibrary}
+	finder.scanParallel(seq, 0, len(seq), tiler.Threads, fn)
+}
+
+// outOfOrder returns true if tag f should be skipped (when SkipOOO is
+// enabled), given the last tag accepted and the next tag found after
+// f (nil if f is the last tag found).
+func (tiler *Tiler) outOfOrder(label string, f, last foundTag, next *foundTag) bool {
+	if f.tagid < last.tagid+1 {
+		log.Debugf("%s skipped out-of-order tag %d (found at %d) because it appears after tag %d (found at %d)", label, f.tagid, f.pos, last.tagid, last.pos)
+		return true
+	}
+	if f.tagid > last.tagid+1 && // accepting this tag would mean skipping some tags
+		next != nil && // there is a "next" found tag after this one
+		next.tagid > last.tagid && // next found tag is usable (we haven't already passed it in accepted sequence)
+		next.tagid <= f.tagid { // next found tag is expected before this one (so we can't use both)
+		log.Debugf("%s skipped out-of-order tag %d (found at %d) because it appears between tag %d (found at %d) and %d (found at %d)", label, f.tagid, f.pos, last.tagid, last.pos, next.tagid, next.pos)
+		return true
+	}
+	return false
+}
+
+// lower converts buf to lower case in place.
+func lower(buf []byte) {
+	for i, b := range buf {
+		if 'A' <= b && b <= 'Z' {
+			buf[i] = b + 'a' - 'A'
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package tiling
+
+import (
+	"bytes"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"gopkg.in/check.v1"
+)
+
+type tilerSuite struct{}
+
+var _ = check.Suite(&tilerSuite{})
+
+func (s *tilerSuite) TestSkipOOO(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccac
+cctcccgagccgagccacccgtca
+gttattaataataacttatcatca
+`))
+	c.Assert(err, check.IsNil)
+
+	// tags appear in seq: 4, 0, 2 (but skipOOO is false)
+	tiler := &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: false}
+	tseq, err := tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+gttattaataataacttatcatca
+ggggggggggggggggggggggg
+ggagaactgtgctccgccttcaga
+cccccccccccccccccccc
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{4, 1, 1}, {0, 1, 2}, {2, 1, 1}}})
+
+	// tags appear in seq: 0, 1, 2 -> don't skip
+	tiler = &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: true}
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+ggagaactgtgctccgccttcaga
+cccccccccccccccccccc
+acacatgctagcgcgtcggggtgg
+ggggggggggggggggggggggg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 1}, {1, 1, 1}, {2, 1, 1}}})
+
+	// tags appear in seq: 2, 3, 4 -> don't skip
+	tiler = &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: true}
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+gactctagcagagtggccagccac
+cccccccccccccccccccc
+cctcccgagccgagccacccgtca
+ggggggggggggggggggggggg
+gttattaataataacttatcatca
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{2, 1, 1}, {3, 1, 1}, {4, 1, 1}}})
+
+	// tags appear in seq: 4, 0, 2 -> skip 4
+	tiler = &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: true}
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+gttattaataataacttatcatca
+cccccccccccccccccccc
+ggagaactgtgctccgccttcaga
+ggggggggggggggggggggggg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 2}, {2, 1, 1}}})
+
+	// tags appear in seq: 0, 2, 1 -> skip 2
+	tiler = &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: true}
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+ggagaactgtgctccgccttcaga
+cccccccccccccccccccc
+gactctagcagagtggccagccac
+ggggggggggggggggggggggg
+acacatgctagcgcgtcggggtgg
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 1}, {1, 1, 1}}})
+
+	// tags appear in seq: 0, 1, 1, 2 -> skip second tag1
+	tiler = &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: true}
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+ggagaactgtgctccgccttcaga
+cccccccccccccccccccc
+acacatgctagcgcgtcggggtgg
+ggggggggggggggggggggggg
+acacatgctagcgcgtcggggtgg
+ggggggggggggggggggggggg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 1}, {1, 1, 1}, {2, 1, 1}}})
+
+	// tags appear in seq: 0, 1, 3, 0, 4 -> skip second tag0
+	tiler = &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: true}
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+ggagaactgtgctccgccttcaga
+cccccccccccccccccccc
+acacatgctagcgcgtcggggtgg
+ggggggggggggggggggggggg
+cctcccgagccgagccacccgtca
+ggggggggggggggggggggggg
+ggagaactgtgctccgccttcaga
+ggggggggggggggggggggggg
+gttattaataataacttatcatca
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 1}, {1, 1, 2}, {3, 1, 1}, {4, 1, 1}}})
+
+	// tags appear in seq: 0, 1, 3 -> don't skip
+	tiler = &Tiler{TagLibrary: &taglib, TileLibrary: NewTileLibrary(taglib.Len()), SkipOOO: true}
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(`>test-seq
+ggagaactgtgctccgccttcaga
+cccccccccccccccccccc
+acacatgctagcgcgtcggggtgg
+ggggggggggggggggggggggg
+cctcccgagccgagccacccgtca
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 1}, {1, 1, 2}, {3, 1, 1}}})
+}
+
+func (s *tilerSuite) TestReverseStrand(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	fwd := []byte(`ggagaactgtgctccgccttcagacccccccccccccccacacatgctagcgcgtcggggtggttttgactctagcagagtggccagccacaaaa`)
+	tiler := NewTiler(&taglib)
+	tseq, err := tiler.TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+string(fwd)+"\n"))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 1}, {1, 1, 1}, {2, 1, 1}}})
+
+	// The same sequence on the reverse strand yields the same
+	// tile variants.
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+string(ReverseComplement(fwd))+"\n"))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq, check.DeepEquals, TileSeq{"test-seq": []TileLibRef{{0, 1, 1}, {1, 1, 1}, {2, 1, 1}}})
+	c.Check(tiler.TileLibrary.Len(), check.Equals, 3)
+}
+
+func (s *tilerSuite) TestTile(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	tiler := NewTiler(&taglib)
+	var added []TileLibRef
+	tiler.TileLibrary.NewVariant = func(tag TagID, variant TileVariantID, hash [blake2b.Size256]byte, seq []byte) error {
+		c.Check(hash, check.Equals, blake2b.Sum256(seq))
+		added = append(added, TileLibRef{Tag: tag, Variant: variant})
+		return nil
+	}
+	path, err := tiler.Tile([]byte(`GGAGAACTGTGCTCCGCCTTCAGAcccccacacatgctagcgcgtcggggtggtttttgactctagcagagtggccagccac`))
+	c.Assert(err, check.IsNil)
+	c.Check(path, check.DeepEquals, []TileLibRef{{0, 1, 1}, {1, 1, 1}, {2, 1, 1}})
+	c.Check(added, check.DeepEquals, []TileLibRef{{Tag: 0, Variant: 1}, {Tag: 1, Variant: 1}, {Tag: 2, Variant: 1}})
+
+	// A different sequence for tag 1 is a new variant, and a
+	// tile with no-calls is variant 0.
+	path, err = tiler.Tile([]byte(`ggagaactgtgctccgccttcagannnnnacacatgctagcgcgtcggggtggaaaaagactctagcagagtggccagccac`))
+	c.Assert(err, check.IsNil)
+	c.Check(path, check.DeepEquals, []TileLibRef{{0, 0, 1}, {1, 2, 1}, {2, 1, 1}})
+	c.Check(added, check.HasLen, 4)
+	c.Check(tiler.TileLibrary.Len(), check.Equals, 4)
+}
+
+func (s *tilerSuite) TestKeepPartial(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	tiler := NewTiler(&taglib)
+	tiler.TileLibrary.KeepPartial = true
+	var partial []TileLibRef
+	tiler.TileLibrary.NewVariant = func(tag TagID, variant TileVariantID, hash [blake2b.Size256]byte, seq []byte) error {
+		if NoCalls(seq) != nil {
+			partial = append(partial, TileLibRef{Tag: tag, Variant: variant})
+		}
+		return nil
+	}
+	path, err := tiler.Tile([]byte(`ggagaactgtgctccgccttcagacccccacacatgctagcgcgtcggggtggtttttgactctagcagagtggccagccac`))
+	c.Assert(err, check.IsNil)
+	c.Check(path, check.DeepEquals, []TileLibRef{{0, 1, 1}, {1, 1, 1}, {2, 1, 1}})
+
+	// A tile with no-calls gets its own variant ID, and the same
+	// partial tile gets the same ID next time.
+	for i := 0; i < 2; i++ {
+		path, err = tiler.Tile([]byte(`ggagaactgtgctccgccttcagacncnnacacatgctagcgcgtcggggtggtttttgactctagcagagtggccagccac`))
+		c.Assert(err, check.IsNil)
+		c.Check(path, check.DeepEquals, []TileLibRef{{0, 2, 1}, {1, 1, 1}, {2, 1, 1}})
+	}
+	c.Check(partial, check.DeepEquals, []TileLibRef{{Tag: 0, Variant: 2}})
+	c.Check(tiler.TileLibrary.Len(), check.Equals, 4)
+}
+
+func (s *tilerSuite) TestNoCalls(c *check.C) {
+	c.Check(NoCalls([]byte("acgt")), check.IsNil)
+	c.Check(NoCalls([]byte("nacnnntn")), check.DeepEquals, []NoCallRange{{0, 1}, {3, 6}, {7, 8}})
+}
+
+func (s *tilerSuite) TestIncludeExclude(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+`))
+	c.Assert(err, check.IsNil)
+	fasta := ""
+	for _, label := range []string{"chr1", "chr1_random", "chr2", "chrUn_gl000220", "chrM"} {
+		fasta += ">" + label + "\nggagaactgtgctccgccttcagaccccacacatgctagcgcgtcggggtgg\n"
+	}
+	labels := func(tseq TileSeq) []string {
+		var ret []string
+		for label := range tseq {
+			ret = append(ret, label)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	// By default, labels with "_" are skipped.
+	tiler := NewTiler(&taglib)
+	tseq, err := tiler.TileFasta("test-label", bytes.NewBufferString(fasta))
+	c.Assert(err, check.IsNil)
+	c.Check(labels(tseq), check.DeepEquals, []string{"chr1", "chr2", "chrM"})
+
+	tiler.Include = regexp.MustCompile(`^chr[0-9]+`)
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(fasta))
+	c.Assert(err, check.IsNil)
+	c.Check(labels(tseq), check.DeepEquals, []string{"chr1", "chr2"})
+
+	tiler.Exclude = nil
+	tseq, err = tiler.TileFasta("test-label", bytes.NewBufferString(fasta))
+	c.Assert(err, check.IsNil)
+	c.Check(labels(tseq), check.DeepEquals, []string{"chr1", "chr1_random", "chr2"})
+}
+
+func (s *tilerSuite) TestLocateFasta(c *check.C) {
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(`>0000.00
+ggagaactgtgctccgccttcaga
+acacatgctagcgcgtcggggtgg
+gactctagcagagtggccagccac
+`))
+	c.Assert(err, check.IsNil)
+	fwd := "ggagaactgtgctccgccttcagacccccacacatgctagcgcgtcggggtggttttgactctagcagagtggccagccacaaaa"
+	tiler := NewTiler(&taglib)
+	tps, err := tiler.LocateFasta("test-label", bytes.NewBufferString(">chr1\n"+fwd+"\n>chr1_random\n"+fwd+"\n>chr2\ntt"+string(ReverseComplement([]byte(fwd)))+"\n"))
+	c.Assert(err, check.IsNil)
+	c.Check(tps, check.DeepEquals, []TagPosition{
+		{0, "chr1", 0, 24},
+		{1, "chr1", 29, 53},
+		{2, "chr1", 57, 81},
+		// chr2 is reverse-complemented for tiling, but
+		// positions are on the forward strand
+		{0, "chr2", 63, 87},
+		{1, "chr2", 34, 58},
+		{2, "chr2", 6, 30},
+	})
+	c.Check(tiler.TileLibrary.Len(), check.Equals, 0)
+}
+
+func (s *tilerSuite) TestTileFastaStreaming(c *check.C) {
+	defer func(n, size, piece, batch int) {
+		strandDecisionTags, readChunkSize, minScanPiece, minHashBatch = n, size, piece, batch
+	}(strandDecisionTags, readChunkSize, minScanPiece, minHashBatch)
+	strandDecisionTags, readChunkSize, minScanPiece, minHashBatch = 5, 50, 50, 2
+
+	rnd := rand.New(rand.NewSource(1))
+	randomSeq := func(n int) []byte {
+		seq := make([]byte, n)
+		for i := range seq {
+			seq[i] = "acgt"[rnd.Intn(4)]
+		}
+		return seq
+	}
+	var tags [][]byte
+	taglibfasta := ">0000.00\n"
+	for i := 0; i < 100; i++ {
+		// mix of short and long tags, so tags can
+		// extend past the end of a chunk
+		tag := randomSeq(24 + 16*(i%3))
+		tags = append(tags, tag)
+		taglibfasta += string(tag) + "\n"
+	}
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(taglibfasta))
+	c.Assert(err, check.IsNil)
+
+	var seq []byte
+	for i := range tags {
+		seq = append(seq, randomSeq(rnd.Intn(80))...)
+		switch {
+		case i%17 == 5:
+			// missing tag
+		case i%13 == 7:
+			// out-of-order tag
+			seq = append(seq, tags[(i+30)%len(tags)]...)
+		case i%19 == 9:
+			// tag on reverse strand
+			seq = append(seq, ReverseComplement(tags[i])...)
+		case i%11 == 3:
+			// duplicate tag
+			seq = append(seq, tags[i]...)
+			seq = append(seq, randomSeq(10)...)
+			seq = append(seq, tags[i]...)
+		default:
+			seq = append(seq, tags[i]...)
+		}
+	}
+	seq = append(seq, randomSeq(30)...)
+
+	for _, trial := range []struct {
+		skipOOO bool
+		threads int
+	}{
+		{false, 1},
+		{true, 1},
+		{false, 4},
+		{true, 4},
+	} {
+		for _, input := range [][]byte{seq, ReverseComplement(seq), seq[:300]} {
+			var hashes [2][][blake2b.Size256]byte
+			newTiler := func(i int) *Tiler {
+				tiler := NewTiler(&taglib)
+				tiler.SkipOOO = trial.skipOOO
+				tiler.Threads = 1
+				tiler.TileLibrary.NewVariant = func(tag TagID, variant TileVariantID, hash [blake2b.Size256]byte, seq []byte) error {
+					hashes[i] = append(hashes[i], hash)
+					return nil
+				}
+				return tiler
+			}
+			expect, err := newTiler(0).Tile(append([]byte(nil), input...))
+			c.Assert(err, check.IsNil)
+			c.Assert(len(expect) > 2, check.Equals, true)
+			tiler := newTiler(1)
+			tiler.Threads = trial.threads
+			tseq, err := tiler.TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+strings.ToUpper(string(input))+"\n"))
+			c.Assert(err, check.IsNil)
+			c.Check(tseq["test-seq"], check.DeepEquals, expect)
+			c.Check(hashes[1], check.DeepEquals, hashes[0])
+		}
+	}
+}
+
+func (s *tilerSuite) TestStrandDecision(c *check.C) {
+	defer func(n int) { strandDecisionTags = n }(strandDecisionTags)
+	strandDecisionTags = 5
+
+	rnd := rand.New(rand.NewSource(1))
+	randomSeq := func(n int) []byte {
+		seq := make([]byte, n)
+		for i := range seq {
+			seq[i] = "acgt"[rnd.Intn(4)]
+		}
+		return seq
+	}
+	var tags [][]byte
+	taglibfasta := ">0000.00\n"
+	for i := 0; i < 20; i++ {
+		tag := randomSeq(24)
+		tags = append(tags, tag)
+		taglibfasta += string(tag) + "\n"
+	}
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(taglibfasta))
+	c.Assert(err, check.IsNil)
+
+	// The first 5 tags are on the forward strand, but most of
+	// the tags in the whole sequence are on the reverse strand.
+	// Both Tile and TileFasta decide on the first 5 tags, so the
+	// sequence is not reverse-complemented, and the tags on the
+	// reverse strand are ignored.
+	var seq []byte
+	for i, tag := range tags {
+		seq = append(seq, randomSeq(40)...)
+		if i < strandDecisionTags {
+			seq = append(seq, tag...)
+		} else {
+			seq = append(seq, ReverseComplement(tag)...)
+		}
+	}
+	seq = append(seq, randomSeq(40)...)
+
+	path, err := NewTiler(&taglib).Tile(append([]byte(nil), seq...))
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.HasLen, strandDecisionTags)
+	for i, ref := range path {
+		c.Check(ref.Tag, check.Equals, TagID(i))
+	}
+	tseq, err := NewTiler(&taglib).TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+string(seq)+"\n"))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq["test-seq"], check.DeepEquals, path)
+
+	// Conversely, if the first 5 tags are on the reverse strand,
+	// both tile the reverse complement, even though most of the
+	// tags are on the forward strand.
+	seq = nil
+	for i, tag := range tags {
+		seq = append(seq, randomSeq(40)...)
+		if i < strandDecisionTags {
+			seq = append(seq, ReverseComplement(tag)...)
+		} else {
+			seq = append(seq, tag...)
+		}
+	}
+	seq = append(seq, randomSeq(40)...)
+
+	path, err = NewTiler(&taglib).Tile(append([]byte(nil), seq...))
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.HasLen, strandDecisionTags)
+	for i, ref := range path {
+		c.Check(ref.Tag, check.Equals, TagID(strandDecisionTags-1-i))
+	}
+	tseq, err = NewTiler(&taglib).TileFasta("test-label", bytes.NewBufferString(">test-seq\n"+string(seq)+"\n"))
+	c.Assert(err, check.IsNil)
+	c.Check(tseq["test-seq"], check.DeepEquals, path)
+}
+
+// BenchmarkTileFasta tiles genomes with 4 threads, like import does,
+// using a library that already has most of the tile variants. Run
+// with "go test -check.b".
+func (s *tilerSuite) BenchmarkTileFasta(c *check.C) {
+	rnd := rand.New(rand.NewSource(1))
+	randomSeq := func(n int) []byte {
+		seq := make([]byte, n)
+		for i := range seq {
+			seq[i] = "acgt"[rnd.Intn(4)]
+		}
+		return seq
+	}
+	const ntags = 2000
+	taglibfasta := ">0000.00\n"
+	var ref []byte
+	for i := 0; i < ntags; i++ {
+		tag := randomSeq(24)
+		taglibfasta += string(tag) + "\n"
+		ref = append(ref, randomSeq(226)...)
+		ref = append(ref, tag...)
+	}
+	var taglib TagLibrary
+	err := taglib.Load(bytes.NewBufferString(taglibfasta))
+	c.Assert(err, check.IsNil)
+
+	// Each genome has a SNP in about 1 of 10 tiles, so a few
+	// tags accumulate many variants.
+	var genomes [][]byte
+	for g := 0; g < 40; g++ {
+		seq := append([]byte(nil), ref...)
+		for i := 0; i < ntags/10; i++ {
+			pos := rnd.Intn(len(seq))
+			if pos%250 < 226 {
+				seq[pos] = "acgt"[rnd.Intn(4)]
+			}
+		}
+		genomes = append(genomes, []byte(">chr1\n"+string(seq)+"\n"))
+	}
+
+	tiler := NewTiler(&taglib)
+	tiler.Threads = 4
+	for _, genome := range genomes {
+		_, err := tiler.TileFasta("bench", bytes.NewReader(genome))
+		c.Assert(err, check.IsNil)
+	}
+	c.SetBytes(int64(len(ref)))
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		_, err := tiler.TileFasta("bench", bytes.NewReader(genomes[i%len(genomes)]))
+		c.Assert(err, check.IsNil)
+	}
+}
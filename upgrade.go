@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/arvados/lightning/tiling"
+	log "github.com/sirupsen/logrus"
+)
+
+type upgradeLibrary struct{}
+
+func (cmd *upgradeLibrary) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+		}
+	}()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pprof := flags.String("pprof", "", "serve Go profile data at http://`[addr]:port`")
+	runlocal := flags.Bool("local", false, "run on local host (default: run in an arvados container)")
+	projectUUID := flags.String("project", "", "project `UUID` for output data")
+	priority := flags.Int("priority", 500, "container request priority")
+	inputFilename := flags.String("i", "-", "input `file`")
+	outputFilename := flags.String("o", "-", "output `file`")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if *pprof != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*pprof, nil))
+		}()
+	}
+
+	if !*runlocal {
+		if *outputFilename != "-" {
+			err = errors.New("cannot specify output file in container mode: not implemented")
+			return 1
+		}
+		runner := arvadosContainerRunner{
+			Name:        "lightning upgrade-library",
+			Client:      arvados.NewClientFromEnv(),
+			ProjectUUID: *projectUUID,
+			RAM:         16000000000,
+			VCPUs:       2,
+			Priority:    *priority,
+		}
+		err = runner.TranslatePaths(inputFilename)
+		if err != nil {
+			return 1
+		}
+		runner.Args = []string{"upgrade-library", "-local=true", "-i", *inputFilename, "-o", "/mnt/output/library.gob"}
+		var output string
+		output, err = runner.Run()
+		if err != nil {
+			return 1
+		}
+		fmt.Fprintln(stdout, output+"/library.gob")
+		return 0
+	}
+
+	var input io.ReadCloser
+	if *inputFilename == "-" {
+		input = ioutil.NopCloser(stdin)
+	} else {
+		input, err = os.Open(*inputFilename)
+		if err != nil {
+			return 1
+		}
+		defer input.Close()
+	}
+	var output io.WriteCloser
+	if *outputFilename == "-" {
+		output = nopCloser{stdout}
+	} else {
+		output, err = os.OpenFile(*outputFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return 1
+		}
+		defer output.Close()
+	}
+	bufw := bufio.NewWriter(output)
+	enc, err := newLibraryEncoder(bufw)
+	if err != nil {
+		return 1
+	}
+	err = upgrade(bufio.NewReader(input), func(ent *LibraryEntry) error {
+		return enc.Encode(ent)
+	})
+	if err != nil {
+		return 1
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return 1
+	}
+	err = output.Close()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// upgrade calls cb for each entry in the given library stream,
+// converting entries from older format versions as needed.
+func upgrade(rdr *bufio.Reader, cb func(*LibraryEntry) error) error {
+	magic, err := rdr.Peek(len(libraryMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var dec *gob.Decoder
+	version := 0
+	if bytes.Equal(magic, libraryMagic) {
+		var hdr *LibraryHeader
+		dec, hdr, err = decodeLibraryHeaderAnyVersion(rdr)
+		if err != nil {
+			return err
+		}
+		if hdr.FormatVersion > libraryFormatVersion {
+			return fmt.Errorf("unsupported library format version %d (written by lightning %s), expected version %d or older", hdr.FormatVersion, hdr.LightningVersion, libraryFormatVersion)
+		} else if hdr.FormatVersion == libraryFormatVersion {
+			log.Printf("input is format version %d (written by lightning %s), no conversion needed", hdr.FormatVersion, hdr.LightningVersion)
+			return decodeLibraryEntries(dec, cb)
+		}
+		version = hdr.FormatVersion
+		log.Printf("input is format version %d (written by lightning %s), converting to format version %d", hdr.FormatVersion, hdr.LightningVersion, libraryFormatVersion)
+	} else {
+		log.Printf("input has no header, converting from format version 0 to format version %d", libraryFormatVersion)
+		dec = gob.NewDecoder(rdr)
+	}
+	return decodeLibraryEntries(dec, func(ent *LibraryEntry) error {
+		upgradeEntry(ent, version)
+		return cb(ent)
+	})
+}
+
+// upgradeEntry converts ent, decoded from a library with the given
+// format version, to the current format version.
+func upgradeEntry(ent *LibraryEntry, version int) {
+	// Version 0 (no header) entries are the same as version 1
+	// entries.
+	if version < 2 {
+		// Version 2 added NoCalls. Older versions did not
+		// store partial tiles, but fill it in anyway in case
+		// a sequence has no-calls.
+		for i := range ent.TileVariants {
+			ent.TileVariants[i].NoCalls = tiling.NoCalls(ent.TileVariants[i].Sequence)
+		}
+	}
+	// Version 3 added Spans. Older versions did not record
+	// spanning tiles, so every tile spans one tag, which is what
+	// an empty Spans means.
+	//
+	// Version 4 added UnphasedTags. Genomes in older versions
+	// are treated as fully phased, as they were before.
+}
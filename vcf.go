@@ -0,0 +1,837 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/arvados/lightning/tiling"
+	log "github.com/sirupsen/logrus"
+)
+
+// vcfFile is a VCF (or gVCF) file, either plain or compressed with
+// bgzip. If the file has a tabix (.tbi) or CSI (.csi) index, the
+// index is used to find the records for each chromosome; otherwise,
+// the file is read from start to end, so the chromosomes must appear
+// in the same order as in the reference, and any records on
+// chromosomes that are not in the reference must come after all of
+// the others.
+type vcfFile struct {
+	filename string
+	samples  []string
+	contigs  []string          // from ##contig header lines
+	offset   map[string]uint64 // virtual offset of first record of each chromosome, from index
+}
+
+// vcfRecord is a VCF record with at least one non-reference allele
+// in a sample genotype.
+type vcfRecord struct {
+	chrom   string
+	pos     int // 0-based
+	ref     []byte
+	alts    [][]byte
+	gtIndex int      // index of GT in the FORMAT field
+	samples [][]byte // sample columns (only as many as requested from parseVCFRecord)
+}
+
+var vcfContigRegexp = regexp.MustCompile(`^##contig=<(.*,)?ID=([^,>]+)`)
+
+// openVCF reads the header (and index, if any) of a VCF file.
+func openVCF(filename string) (*vcfFile, error) {
+	vf := &vcfFile{filename: filename}
+	f, rdr, err := vf.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	for {
+		line, err := rdr.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil, fmt.Errorf("%s: no #CHROM header line", filename)
+		} else if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if m := vcfContigRegexp.FindSubmatch(line); m != nil {
+			vf.contigs = append(vf.contigs, string(m[2]))
+		} else if bytes.HasPrefix(line, []byte("#CHROM\t")) {
+			fields := strings.Split(string(line), "\t")
+			if len(fields) > 9 {
+				vf.samples = fields[9:]
+			}
+			break
+		} else if len(line) > 0 && line[0] != '#' {
+			return nil, fmt.Errorf("%s: no #CHROM header line", filename)
+		}
+	}
+	if len(vf.samples) == 0 {
+		return nil, fmt.Errorf("%s: no samples", filename)
+	}
+	if strings.HasSuffix(filename, ".gz") {
+		for _, suffix := range []string{".csi", ".tbi"} {
+			if _, err := os.Stat(filename + suffix); err == nil {
+				vf.offset, err = readVCFIndex(filename+suffix, vf.contigs)
+				if err != nil {
+					return nil, fmt.Errorf("%s%s: %s", filename, suffix, err)
+				}
+				break
+			}
+		}
+	}
+	return vf, nil
+}
+
+// open opens the file and returns a reader for the (uncompressed)
+// data.
+func (vf *vcfFile) open() (*os.File, *bufio.Reader, error) {
+	f, err := os.Open(vf.filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rdr io.Reader = f
+	if strings.HasSuffix(vf.filename, ".gz") {
+		rdr, err = gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s: gzip: %s", vf.filename, err)
+		}
+	}
+	return f, bufio.NewReaderSize(rdr, 1<<20), nil
+}
+
+// openAt opens the (bgzipped) file and returns a reader for the
+// uncompressed data starting at the given virtual offset.
+func (vf *vcfFile) openAt(voffset uint64) (*os.File, *bufio.Reader, error) {
+	f, err := os.Open(vf.filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A bgzip virtual offset is the file offset of a gzip member
+	// (upper 48 bits) and an offset into its uncompressed data
+	// (lower 16 bits).
+	_, err = f.Seek(int64(voffset>>16), io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: gzip: %s", vf.filename, err)
+	}
+	rdr := bufio.NewReaderSize(gz, 1<<20)
+	_, err = rdr.Discard(int(voffset & 0xffff))
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %s", vf.filename, err)
+	}
+	return f, rdr, nil
+}
+
+// vcfLines reads the data lines of a VCF file, skipping header
+// lines, with one line of lookahead.
+type vcfLines struct {
+	rdr   *bufio.Reader
+	line  []byte // next line, or nil if not read yet
+	chrom string // chromosome of next line
+	prev  string // chromosome of the last line read
+	eof   bool
+}
+
+// peek reads the next data line into vl.line, if it has not been
+// read yet, or sets vl.eof.
+func (vl *vcfLines) peek() error {
+	for vl.line == nil && !vl.eof {
+		line, err := vl.rdr.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			vl.eof = true
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		tab := bytes.IndexByte(line, '\t')
+		if tab < 0 {
+			return fmt.Errorf("cannot parse VCF record (too few fields): %q", line)
+		}
+		vl.line, vl.chrom = line, string(line[:tab])
+	}
+	return nil
+}
+
+// vcfReader reads the records of a VCF file, one chromosome at a
+// time, in reference order.
+type vcfReader struct {
+	vf       *vcfFile
+	nsamples int // number of sample columns to parse
+
+	// If the file is not indexed, it is read sequentially
+	// (opened on first use).
+	f     *os.File
+	lines *vcfLines
+}
+
+// has returns true if the file has records on the given chromosome
+// that have not been read yet. done lists the chromosomes that have
+// already been read (or skipped); if the next record in an
+// unindexed file is on one of them, the file is not sorted in
+// reference order.
+func (vr *vcfReader) has(chrom string, done map[string]bool) (bool, error) {
+	if vr.vf.offset != nil {
+		_, ok := vr.vf.offset[chrom]
+		return ok, nil
+	}
+	if vr.lines == nil {
+		f, rdr, err := vr.vf.open()
+		if err != nil {
+			return false, err
+		}
+		vr.f, vr.lines = f, &vcfLines{rdr: rdr}
+	}
+	if err := vr.lines.peek(); err != nil {
+		return false, fmt.Errorf("%s: %s", vr.vf.filename, err)
+	} else if vr.lines.eof {
+		return false, nil
+	} else if done[vr.lines.chrom] {
+		return false, vr.errOrder(vr.lines.chrom, done)
+	}
+	return vr.lines.chrom == chrom, nil
+}
+
+// each calls fn for each record on the given chromosome that has a
+// non-reference allele (see parseVCFRecord). It returns an error if
+// the records are not sorted by position.
+func (vr *vcfReader) each(chrom string, fn func(*vcfRecord) error) error {
+	lines := vr.lines
+	if vr.vf.offset != nil {
+		voffset, ok := vr.vf.offset[chrom]
+		if !ok {
+			return nil
+		}
+		f, rdr, err := vr.vf.openAt(voffset)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		lines = &vcfLines{rdr: rdr}
+	}
+	prevPos := -1
+	for {
+		err := lines.peek()
+		if err != nil {
+			return fmt.Errorf("%s: %s", vr.vf.filename, err)
+		} else if lines.eof || lines.chrom != chrom {
+			return nil
+		}
+		line := lines.line
+		lines.line, lines.prev = nil, lines.chrom
+		pos, err := vcfPos(line)
+		if err != nil {
+			return fmt.Errorf("%s: %s", vr.vf.filename, err)
+		} else if pos < prevPos {
+			return fmt.Errorf("%s:%d: record is out of order (previous record was at %s:%d), VCF file must be sorted by position", chrom, pos+1, chrom, prevPos+1)
+		}
+		prevPos = pos
+		rec, err := parseVCFRecord(line, vr.nsamples)
+		if err != nil {
+			return fmt.Errorf("%s: %s", vr.vf.filename, err)
+		} else if rec == nil {
+			continue
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// finish checks the rest of an unindexed file, after all of the
+// chromosomes in done have been read. Records on other chromosomes
+// (which are not in the reference) are ignored, as long as no
+// records on the chromosomes in done come after them.
+func (vr *vcfReader) finish(done map[string]bool) error {
+	if vr.lines == nil {
+		return nil
+	}
+	for {
+		err := vr.lines.peek()
+		if err != nil {
+			return fmt.Errorf("%s: %s", vr.vf.filename, err)
+		} else if vr.lines.eof {
+			return nil
+		} else if done[vr.lines.chrom] {
+			return vr.errOrder(vr.lines.chrom, done)
+		}
+		vr.lines.line, vr.lines.prev = nil, vr.lines.chrom
+	}
+}
+
+func (vr *vcfReader) errOrder(chrom string, done map[string]bool) error {
+	if prev := vr.lines.prev; prev != "" && !done[prev] {
+		return fmt.Errorf("%s: records for %s come after records for %s, which is not in the reference (without an index, records for sequences that are not in the reference must come last)", vr.vf.filename, chrom, prev)
+	}
+	return fmt.Errorf("%s: records for %s are not in the same order as the reference sequences (sort the VCF file in reference order, or index it)", vr.vf.filename, chrom)
+}
+
+func (vr *vcfReader) close() {
+	if vr.f != nil {
+		vr.f.Close()
+		vr.f, vr.lines = nil, nil
+	}
+}
+
+// vcfPos returns the (0-based) position of a VCF record.
+func vcfPos(line []byte) (int, error) {
+	fields := bytes.SplitN(line, []byte{'\t'}, 3)
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("cannot parse VCF record (too few fields): %q", line)
+	}
+	pos, err := strconv.Atoi(string(fields[1]))
+	if err != nil || pos < 1 {
+		return 0, fmt.Errorf("cannot parse VCF record (bad POS %q): %q", fields[1], line)
+	}
+	return pos - 1, nil
+}
+
+// parseVCFRecord parses a VCF data line, including the first
+// nsamples sample columns. It returns nil if the record has no
+// non-reference alleles that could be applied to a consensus
+// sequence (e.g., a gVCF reference block).
+func parseVCFRecord(line []byte, nsamples int) (*vcfRecord, error) {
+	fields := bytes.SplitN(line, []byte{'\t'}, 10+nsamples)
+	if len(fields) < 10 {
+		return nil, fmt.Errorf("cannot parse VCF record (too few fields): %q", line)
+	}
+	alts := bytes.Split(fields[4], []byte{','})
+	usable := false
+	for _, alt := range alts {
+		if vcfAlleleUsable(alt) {
+			usable = true
+			break
+		}
+	}
+	if !usable {
+		return nil, nil
+	}
+	pos, err := strconv.Atoi(string(fields[1]))
+	if err != nil || pos < 1 {
+		return nil, fmt.Errorf("cannot parse VCF record (bad POS %q): %q", fields[1], line)
+	}
+	samples := fields[9:]
+	if len(samples) > nsamples {
+		// the last field is the rest of the line
+		samples = samples[:nsamples]
+	}
+	rec := &vcfRecord{
+		chrom:   string(fields[0]),
+		pos:     pos - 1,
+		ref:     fields[3],
+		alts:    alts,
+		gtIndex: -1,
+		samples: samples,
+	}
+	for i, key := range bytes.Split(fields[8], []byte{':'}) {
+		if string(key) == "GT" {
+			rec.gtIndex = i
+			break
+		}
+	}
+	if rec.gtIndex < 0 {
+		return nil, nil
+	}
+	return rec, nil
+}
+
+// vcfAlleleUsable returns true if an ALT allele can be applied to a
+// consensus sequence, i.e., it is not missing, symbolic ("<NON_REF>",
+// "<*>", etc.), an overlapping deletion ("*"), or a breakend.
+func vcfAlleleUsable(alt []byte) bool {
+	return len(alt) > 0 &&
+		alt[0] != '<' &&
+		!bytes.Equal(alt, []byte{'.'}) &&
+		!bytes.Equal(alt, []byte{'*'}) &&
+		bytes.IndexAny(alt, "[]") < 0
+}
+
+// allele returns the ALT allele called for the given sample and
+// haplotype (1 or 2), or nil if the sample's genotype for that
+// haplotype is the reference allele, missing, or an allele that
+// cannot be applied (see vcfAlleleUsable).
+//
+// As with "bcftools consensus -H", phasing is ignored: haplotype 1 is
+// the first allele in GT, whether the genotype is phased or not. A
+// haploid genotype is used for both haplotypes.
+func (rec *vcfRecord) allele(sample, phase int) ([]byte, error) {
+	gt := rec.genotype(sample)
+	alleles := bytes.FieldsFunc(gt, func(r rune) bool { return r == '/' || r == '|' })
+	if len(alleles) == 0 {
+		return nil, nil
+	} else if len(alleles) == 1 {
+		phase = 1
+	} else if phase > len(alleles) {
+		return nil, nil
+	}
+	a := alleles[phase-1]
+	if bytes.Equal(a, []byte{'.'}) {
+		return nil, nil
+	}
+	idx, err := strconv.Atoi(string(a))
+	if err != nil || idx < 0 || idx > len(rec.alts) {
+		return nil, fmt.Errorf("%s:%d: invalid genotype %q", rec.chrom, rec.pos+1, gt)
+	} else if idx == 0 || !vcfAlleleUsable(rec.alts[idx-1]) {
+		return nil, nil
+	}
+	return rec.alts[idx-1], nil
+}
+
+// genotype returns the GT field of the given sample, or nil if the
+// sample has no GT.
+func (rec *vcfRecord) genotype(sample int) []byte {
+	if sample >= len(rec.samples) {
+		return nil
+	}
+	gt := rec.samples[sample]
+	for i := 0; i < rec.gtIndex; i++ {
+		colon := bytes.IndexByte(gt, ':')
+		if colon < 0 {
+			return nil
+		}
+		gt = gt[colon+1:]
+	}
+	if colon := bytes.IndexByte(gt, ':'); colon >= 0 {
+		gt = gt[:colon]
+	}
+	return gt
+}
+
+// unphased returns true if the given sample has an unphased
+// genotype ("0/1") whose two haplotypes would get different
+// alleles.
+func (rec *vcfRecord) unphased(sample int) bool {
+	if bytes.IndexByte(rec.genotype(sample), '/') < 0 {
+		return false
+	}
+	a1, err1 := rec.allele(sample, 1)
+	a2, err2 := rec.allele(sample, 2)
+	return err1 == nil && err2 == nil && !bytes.Equal(a1, a2)
+}
+
+// bedRegion is a region of a chromosome (0-based, half-open).
+type bedRegion struct {
+	start, end int
+}
+
+// readBED reads regions from a BED file, and returns them grouped by
+// chromosome and sorted by start position.
+func readBED(rdr io.Reader) (map[string][]bedRegion, error) {
+	regions := map[string][]bedRegion{}
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "track" || fields[0] == "browser" || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) < 3 {
+			return nil, fmt.Errorf("cannot parse BED line %q", scanner.Text())
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse BED line %q", scanner.Text())
+		}
+		end, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse BED line %q", scanner.Text())
+		}
+		regions[fields[0]] = append(regions[fields[0]], bedRegion{start, end})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, rs := range regions {
+		sort.Slice(rs, func(i, j int) bool { return rs[i].start < rs[j].start })
+	}
+	return regions, nil
+}
+
+// vcfConsensus builds the sequences of some haplotypes of the samples
+// in one or more VCF files (e.g., one file per chromosome, each with
+// the same samples) by applying each sample's variants to the
+// reference, like "bcftools consensus --haplotype <phase>":
+//
+// Variants that overlap a variant already applied are skipped, with
+// a warning. It is an error if the REF allele of an applied variant
+// does not match the reference. Each applied ALT allele is converted
+// to the case of the reference base where it starts.
+//
+// Positions in the mask regions (if any) are replaced with "N", and
+// variants that overlap a mask region are skipped.
+//
+// It is an error if more than one of the VCF files has records for
+// the same reference sequence.
+//
+// All of the haplotypes are built in a single pass through the
+// reference and the VCF files, so each record is read and parsed
+// only once. Each reference sequence is held in memory while its
+// records are applied.
+type vcfConsensus struct {
+	vcfs       []*vcfFile // all with the same samples
+	refFile    string
+	mask       map[string][]bedRegion
+	haplotypes []*vcfHaplotype
+}
+
+// vcfHaplotype is one haplotype of one sample in a vcfConsensus.
+type vcfHaplotype struct {
+	sample int // index in vcfFile.samples
+	phase  int // 1 or 2
+	w      io.Writer
+
+	// unphased lists the reference regions of the variants with
+	// unphased heterozygous genotypes (see vcfRecord.unphased),
+	// whether or not they were applied. It is filled in by
+	// writeFasta.
+	unphased map[string][]bedRegion
+
+	overlaps int // number of variants skipped because of overlaps
+
+	bufw *bufio.Writer
+	out  *fastaWriter // current sequence
+	ref  []byte       // current reference sequence (masked)
+	pos  int          // position in ref
+}
+
+// writeFasta writes the consensus sequences of each haplotype to its
+// writer in fasta format, with the same sequence labels as the
+// reference, and the same line length as the first line of each
+// reference sequence.
+func (vc *vcfConsensus) writeFasta() error {
+	nsamples := 0
+	for _, hap := range vc.haplotypes {
+		hap.unphased = map[string][]bedRegion{}
+		hap.overlaps = 0
+		hap.bufw = bufio.NewWriterSize(hap.w, 1<<20)
+		if nsamples <= hap.sample {
+			nsamples = hap.sample + 1
+		}
+	}
+	var readers []*vcfReader
+	for _, vf := range vc.vcfs {
+		vr := &vcfReader{vf: vf, nsamples: nsamples}
+		defer vr.close()
+		readers = append(readers, vr)
+	}
+	f, err := os.Open(vc.refFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(vc.refFile, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: gzip: %s", vc.refFile, err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+	fr := tiling.NewFastaReader(in)
+	done := map[string]bool{}
+	for {
+		label, err := fr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", vc.refFile, err)
+		}
+		chrom := strings.SplitN(label, " ", 2)[0]
+		err = vc.writeSequence(label, chrom, fr, readers, done)
+		if err != nil {
+			return err
+		}
+		done[chrom] = true
+	}
+	for _, vr := range readers {
+		err = vr.finish(done)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hap := range vc.haplotypes {
+		err = hap.bufw.Flush()
+		if err != nil {
+			return err
+		}
+		if hap.overlaps > 0 {
+			log.Printf("%s sample %s haplotype %d: skipped %d variants that overlap other variants", vc.vcfs[0].filename, vc.vcfs[0].samples[hap.sample], hap.phase, hap.overlaps)
+		}
+	}
+	return nil
+}
+
+// writeSequence writes the consensus sequences for one reference
+// sequence (read from fr), using the records from whichever of the
+// readers has any.
+func (vc *vcfConsensus) writeSequence(label, chrom string, fr *tiling.FastaReader, readers []*vcfReader, done map[string]bool) error {
+	ref, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return fmt.Errorf("%s: %s", vc.refFile, err)
+	}
+	mask := vc.mask[chrom]
+	for _, r := range mask {
+		for i := r.start; i < r.end && i < len(ref); i++ {
+			if i >= 0 {
+				ref[i] = 'N'
+			}
+		}
+	}
+	for _, hap := range vc.haplotypes {
+		_, err = fmt.Fprintf(hap.bufw, ">%s\n", label)
+		if err != nil {
+			return err
+		}
+		hap.out = &fastaWriter{w: hap.bufw, width: fr.LineWidth()}
+		hap.ref, hap.pos = ref, 0
+	}
+	var vr *vcfReader
+	for _, r := range readers {
+		if has, err := r.has(chrom, done); err != nil {
+			return err
+		} else if !has {
+			continue
+		} else if vr != nil {
+			return fmt.Errorf("%s and %s both have records for %s", vr.vf.filename, r.vf.filename, chrom)
+		}
+		vr = r
+	}
+	if vr != nil {
+		err = vr.each(chrom, func(rec *vcfRecord) error {
+			masked := false
+			for len(mask) > 0 && mask[0].end <= rec.pos {
+				mask = mask[1:]
+			}
+			for _, r := range mask {
+				if r.start >= rec.pos+len(rec.ref) {
+					break
+				} else if r.end > rec.pos {
+					masked = true
+					break
+				}
+			}
+			for _, hap := range vc.haplotypes {
+				if err := hap.apply(rec, masked); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, hap := range vc.haplotypes {
+		_, err = hap.out.Write(hap.ref[hap.pos:])
+		if err != nil {
+			return err
+		}
+		err = hap.out.Close()
+		if err != nil {
+			return err
+		}
+		hap.out, hap.ref = nil, nil
+	}
+	return nil
+}
+
+// apply writes the reference sequence up to the given record, and
+// the record's allele for this haplotype, unless the allele is the
+// reference allele, or the record overlaps a variant already applied
+// or (if masked is true) a mask region.
+func (hap *vcfHaplotype) apply(rec *vcfRecord, masked bool) error {
+	if rec.unphased(hap.sample) {
+		hap.unphased[rec.chrom] = append(hap.unphased[rec.chrom], bedRegion{rec.pos, rec.pos + len(rec.ref)})
+	}
+	alt, err := rec.allele(hap.sample, hap.phase)
+	if err != nil || alt == nil {
+		return err
+	}
+	if rec.pos < hap.pos {
+		log.Debugf("%s:%d overlaps with another variant, skipping", rec.chrom, rec.pos+1)
+		hap.overlaps++
+		return nil
+	} else if masked {
+		return nil
+	} else if rec.pos >= len(hap.ref) {
+		return fmt.Errorf("%s:%d: position is past the end of the reference sequence", rec.chrom, rec.pos+1)
+	}
+	end := rec.pos + len(rec.ref)
+	if end > len(hap.ref) {
+		end = len(hap.ref)
+	}
+	refseq := hap.ref[rec.pos:end]
+	if !bytes.EqualFold(refseq, rec.ref) {
+		return fmt.Errorf("%s:%d: REF allele %q does not match reference sequence %q", rec.chrom, rec.pos+1, rec.ref, refseq)
+	}
+	if refseq[0] >= 'a' && refseq[0] <= 'z' {
+		alt = bytes.ToLower(alt)
+	} else {
+		alt = bytes.ToUpper(alt)
+	}
+	_, err = hap.out.Write(hap.ref[hap.pos:rec.pos])
+	if err != nil {
+		return err
+	}
+	_, err = hap.out.Write(alt)
+	if err != nil {
+		return err
+	}
+	hap.pos = end
+	return nil
+}
+
+// readVCFIndex reads a tabix (.tbi) or CSI (.csi) index file, and
+// returns the virtual offset of the first record of each chromosome.
+//
+// Chromosome names are taken from the index if it has them (as
+// indexes of bgzipped VCF files do), otherwise from the given list
+// of contigs in the VCF header.
+func readVCFIndex(filename string, contigs []string) (map[string]uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	idx := &binaryReader{buf: buf}
+	magic := string(idx.bytes(4))
+	var names []string
+	var nref int
+	var pseudoBin uint32
+	var csi bool
+	switch magic {
+	case "TBI\x01":
+		nref = int(idx.int32())
+		idx.bytes(24) // format, col_seq, col_beg, col_end, meta, skip
+		names = splitIndexNames(idx.bytes(int(idx.int32())))
+		if len(names) != nref {
+			return nil, fmt.Errorf("index has %d names for %d sequences", len(names), nref)
+		}
+		pseudoBin = 37450
+	case "CSI\x01":
+		csi = true
+		idx.int32() // min_shift
+		depth := idx.int32()
+		aux := &binaryReader{buf: idx.bytes(int(idx.int32()))}
+		if len(aux.buf) >= 28 {
+			aux.bytes(24)
+			names = splitIndexNames(aux.bytes(int(aux.int32())))
+		}
+		pseudoBin = uint32((1<<(uint(depth+1)*3))-1)/7 + 1
+		nref = int(idx.int32())
+	default:
+		return nil, fmt.Errorf("unsupported index format (magic %q)", magic)
+	}
+	if names == nil {
+		names = contigs
+	}
+	if len(names) < nref {
+		return nil, fmt.Errorf("index has %d sequences, but only %d names are known", nref, len(names))
+	}
+	offset := map[string]uint64{}
+	for ref := 0; ref < nref && idx.err == nil; ref++ {
+		first, found := uint64(0), false
+		nbin := int(idx.int32())
+		for b := 0; b < nbin && idx.err == nil; b++ {
+			bin := idx.uint32()
+			if csi {
+				idx.uint64() // loffset
+			}
+			nchunk := int(idx.int32())
+			for c := 0; c < nchunk && idx.err == nil; c++ {
+				beg, _ := idx.uint64(), idx.uint64()
+				if bin == pseudoBin {
+					// metadata, not a chunk
+					continue
+				}
+				if !found || beg < first {
+					first, found = beg, true
+				}
+			}
+		}
+		if !csi {
+			idx.bytes(8 * int(idx.int32())) // linear index
+		}
+		if found {
+			offset[names[ref]] = first
+		}
+	}
+	if idx.err != nil {
+		return nil, idx.err
+	}
+	return offset, nil
+}
+
+func splitIndexNames(buf []byte) []string {
+	var names []string
+	for _, name := range bytes.Split(bytes.TrimRight(buf, "\x00"), []byte{0}) {
+		names = append(names, string(name))
+	}
+	return names
+}
+
+// binaryReader reads little-endian values from a buffer. After the
+// first attempt to read past the end of the buffer, err is set and
+// all subsequent reads return zero values.
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (br *binaryReader) bytes(n int) []byte {
+	if br.err != nil || n < 0 || n > len(br.buf) {
+		br.err = errors.New("truncated index file")
+		return nil
+	}
+	ret := br.buf[:n]
+	br.buf = br.buf[n:]
+	return ret
+}
+
+func (br *binaryReader) int32() int32 {
+	if b := br.bytes(4); b != nil {
+		return int32(binary.LittleEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (br *binaryReader) uint32() uint32 {
+	if b := br.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (br *binaryReader) uint64() uint64 {
+	if b := br.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
@@ -20,7 +20,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	log "github.com/sirupsen/logrus"
@@ -150,45 +149,61 @@ func (cmd *vcf2fasta) RunCommand(prog string, args []string, stdin io.Reader, st
 		return 1
 	}
 
-	type job struct {
-		vcffile string
-		phase   int
-	}
-	todo := make(chan job)
-	go func() {
-		for _, infile := range infiles {
+	nworkers := runtime.NumCPU()
+	var jobs []job
+	outfiles := map[string]string{} // output file => input file
+	for _, infile := range infiles {
+		var vf *vcfFile
+		vf, err = openVCF(infile)
+		if err != nil {
+			return 1
+		}
+		for sample, name := range vf.samples {
+			if name == "" || strings.ContainsAny(name, "/"+string(os.PathSeparator)) {
+				err = fmt.Errorf("%s: sample name %q cannot be used in an output file name", infile, name)
+				return 1
+			}
 			for phase := 1; phase <= 2; phase++ {
-				todo <- job{vcffile: infile, phase: phase}
+				outfile := cmd.outputFile(vf, sample, phase)
+				if prev, ok := outfiles[outfile]; ok {
+					err = fmt.Errorf("%s and %s would both be written to output file %s", prev, infile, outfile)
+					return 1
+				}
+				outfiles[outfile] = infile
 			}
 		}
-		close(todo)
-	}()
-
-	done := make(chan error, runtime.NumCPU()*2)
-	var wg sync.WaitGroup
-	for i := 0; i < runtime.NumCPU(); i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for job := range todo {
-				if len(done) > 0 {
-					// a different worker encountered an error
-					return
+		// The mask is computed once for each input file, and
+		// used for all of its samples.
+		var maskOnce sync.Once
+		var mask map[string][]bedRegion
+		var maskErr error
+		// Write both haplotypes of up to nworkers/2 samples
+		// in each pass through the VCF file.
+		batch := nworkers / 2
+		if batch < 1 {
+			batch = 1
+		}
+		for start := 0; start < len(vf.samples); start += batch {
+			var samples []int
+			for sample := start; sample < start+batch && sample < len(vf.samples); sample++ {
+				samples = append(samples, sample)
+			}
+			jobs = append(jobs, job{workers: len(samples) * 2, run: func() error {
+				if cmd.mask {
+					maskOnce.Do(func() { mask, maskErr = cmd.loadMask(vf) })
+					if maskErr != nil {
+						return fmt.Errorf("%s: %s", vf.filename, maskErr)
+					}
 				}
-				err := cmd.vcf2fasta(job.vcffile, job.phase)
+				err := cmd.vcf2fasta(vf, samples, mask)
 				if err != nil {
-					done <- fmt.Errorf("%s phase %d: %s", job.vcffile, job.phase, err)
-					return
+					return fmt.Errorf("%s: %s", vf.filename, err)
 				}
-			}
-		}()
+				return nil
+			}})
+		}
 	}
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	err = <-done
+	err = runJobs(nworkers, jobs)
 	if err != nil {
 		return 1
 	}
@@ -211,221 +226,201 @@ func maybeInDocker(args, mountfiles []string) []string {
 	return dockerrun
 }
 
-func (cmd *vcf2fasta) vcf2fasta(infile string, phase int) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// outputFile returns the name of the output file for one haplotype
+// of one sample: {outputDir}/{basename}.{sample}.{phase}.fasta.gz,
+// where basename is the name of the input file.
+func (cmd *vcf2fasta) outputFile(vf *vcfFile, sample, phase int) string {
+	_, basename := filepath.Split(vf.filename)
+	return filepath.Join(cmd.outputDir, fmt.Sprintf("%s.%s.%d.fasta.gz", basename, vf.samples[sample], phase))
+}
 
-	_, basename := filepath.Split(infile)
-	outfile := filepath.Join(cmd.outputDir, fmt.Sprintf("%s.%d.fasta.gz", basename, phase))
-	outf, err := os.OpenFile(outfile, os.O_CREATE|os.O_WRONLY, 0777)
+// vcf2fasta writes both haplotypes of the given samples to their
+// output files (see outputFile), in a single pass through the VCF
+// file. The output files are compressed concurrently.
+func (cmd *vcf2fasta) vcf2fasta(vf *vcfFile, samples []int, mask map[string][]bedRegion) error {
+	consensus := &vcfConsensus{vcfs: []*vcfFile{vf}, refFile: cmd.refFile, mask: mask}
+	var writers []*io.PipeWriter
+	errs := make(chan error, len(samples)*2)
+	for _, sample := range samples {
+		for phase := 1; phase <= 2; phase++ {
+			pr, pw := io.Pipe()
+			consensus.haplotypes = append(consensus.haplotypes, &vcfHaplotype{sample: sample, phase: phase, w: pw})
+			writers = append(writers, pw)
+			outfile := cmd.outputFile(vf, sample, phase)
+			go func() {
+				err := writeGzipFile(outfile, pr)
+				if err != nil {
+					// unblock the consensus writer
+					pr.CloseWithError(err)
+				}
+				errs <- err
+			}()
+		}
+	}
+	err := consensus.writeFasta()
+	for _, pw := range writers {
+		pw.CloseWithError(err)
+	}
+	for range writers {
+		if writeErr := <-errs; writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// writeGzipFile writes the data from rdr to a new gzip file.
+func writeGzipFile(filename string, rdr io.Reader) error {
+	outf, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
 	if err != nil {
 		return fmt.Errorf("error opening output file: %s", err)
 	}
 	defer outf.Close()
 	gzipw := gzip.NewWriter(outf)
 	defer gzipw.Close()
+	_, err = io.Copy(gzipw, rdr)
+	if err != nil {
+		return err
+	}
+	err = gzipw.Close()
+	if err != nil {
+		return err
+	}
+	return outf.Close()
+}
 
-	var maskfifo string // filename of mask fifo if we're running bedtools, otherwise ""
+// loadMask returns the regions of the reference that are not called
+// in the given gVCF file, according to gvcf_regions.py.
+func (cmd *vcf2fasta) loadMask(vf *vcfFile) (map[string][]bedRegion, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	var wg sync.WaitGroup
-	errs := make(chan error, 2)
-	if cmd.mask {
-		chrSize := map[string]int{}
+	infile := vf.filename
+	chrSize := map[string]int{}
 
-		vcffile, err := os.Open(infile)
+	vcffile, err := os.Open(infile)
+	if err != nil {
+		return nil, err
+	}
+	defer vcffile.Close()
+	var rdr io.Reader = vcffile
+	if strings.HasSuffix(infile, ".gz") {
+		rdr, err = gzip.NewReader(vcffile)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer vcffile.Close()
-		var rdr io.Reader = vcffile
-		if strings.HasSuffix(infile, ".gz") {
-			rdr, err = gzip.NewReader(vcffile)
-			if err != nil {
-				return err
+	}
+	contigre := regexp.MustCompile(`([^=,]*)=([^>,]*)`)
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		if s := scanner.Text(); !strings.HasPrefix(s, "##") {
+			break
+		} else if !strings.HasPrefix(s, "##contig=<") {
+			continue
+		} else {
+			kv := map[string]string{}
+			for _, m := range contigre.FindAllStringSubmatch(s[10:], -1) {
+				kv[m[1]] = m[2]
 			}
-		}
-		contigre := regexp.MustCompile(`([^=,]*)=([^>,]*)`)
-		scanner := bufio.NewScanner(rdr)
-		for scanner.Scan() {
-			if s := scanner.Text(); !strings.HasPrefix(s, "##") {
-				break
-			} else if !strings.HasPrefix(s, "##contig=<") {
-				continue
-			} else {
-				kv := map[string]string{}
-				for _, m := range contigre.FindAllStringSubmatch(s[10:], -1) {
-					kv[m[1]] = m[2]
-				}
-				if kv["ID"] != "" && kv["length"] != "" {
-					chrSize[kv["ID"]], _ = strconv.Atoi(kv["length"])
-				}
+			if kv["ID"] != "" && kv["length"] != "" {
+				chrSize[kv["ID"]], _ = strconv.Atoi(kv["length"])
 			}
 		}
-		if err = scanner.Err(); err != nil {
-			return fmt.Errorf("error scanning input file %q: %s", infile, err)
-		}
-		var regions bytes.Buffer
-		bedargs := []string{"python2", "-", "--gvcf_type", "gatk", infile}
-		bed := exec.CommandContext(ctx, bedargs[0], bedargs[1:]...)
-		bed.Stdin = bytes.NewBuffer(cmd.gvcfRegionsPyData)
-		bed.Stdout = &regions
-		bed.Stderr = cmd.stderr
-		log.Printf("running %v", bed.Args)
-		err = bed.Run()
-		log.Printf("exited %v", bed.Args)
-		if err != nil {
-			return fmt.Errorf("gvcf_regions: %s", err)
-		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning input file %q: %s", infile, err)
+	}
+	var regions bytes.Buffer
+	bedargs := []string{"python2", "-", "--gvcf_type", "gatk", infile}
+	bed := exec.CommandContext(ctx, bedargs[0], bedargs[1:]...)
+	bed.Stdin = bytes.NewBuffer(cmd.gvcfRegionsPyData)
+	bed.Stdout = &regions
+	bed.Stderr = cmd.stderr
+	log.Printf("running %v", bed.Args)
+	err = bed.Run()
+	log.Printf("exited %v", bed.Args)
+	if err != nil {
+		return nil, fmt.Errorf("gvcf_regions: %s", err)
+	}
 
-		if cmd.genomeFile != "" {
-			// Read chromosome sizes from genome file in
-			// case any weren't specified in the VCF
-			// header.
-			genomeFile, err := os.Open(cmd.genomeFile)
-			if err != nil {
-				return fmt.Errorf("error opening genome file %q: %s", cmd.genomeFile, err)
-			}
-			scanner := bufio.NewScanner(genomeFile)
-			for scanner.Scan() {
-				var chr string
-				var size int
-				_, err := fmt.Sscanf(scanner.Text(), "%s\t%d", &chr, &size)
-				if err != nil {
-					return fmt.Errorf("error parsing genome file %q: %s", cmd.genomeFile, err)
-				}
-				if chrSize[chr] == 0 {
-					chrSize[chr] = size
-				}
-			}
-			if err = scanner.Err(); err != nil {
-				return fmt.Errorf("error scanning genome file %q: %s", cmd.genomeFile, err)
-			}
+	if cmd.genomeFile != "" {
+		// Read chromosome sizes from genome file in
+		// case any weren't specified in the VCF
+		// header.
+		genomeFile, err := os.Open(cmd.genomeFile)
+		if err != nil {
+			return nil, fmt.Errorf("error opening genome file %q: %s", cmd.genomeFile, err)
 		}
-
-		// "bedtools complement" expects the chromosome sizes
-		// ("genome file") to appear in the same order as the
-		// chromosomes in the input vcf, so we need to sort
-		// them.
-		scanner = bufio.NewScanner(bytes.NewBuffer(append([]byte(nil), regions.Bytes()...)))
-		var sortedGenomeFile bytes.Buffer
+		scanner := bufio.NewScanner(genomeFile)
 		for scanner.Scan() {
 			var chr string
 			var size int
 			_, err := fmt.Sscanf(scanner.Text(), "%s\t%d", &chr, &size)
 			if err != nil {
-				return fmt.Errorf("error parsing gvcf_regions output: %s", err)
+				return nil, fmt.Errorf("error parsing genome file %q: %s", cmd.genomeFile, err)
 			}
-			if size, ok := chrSize[chr]; ok {
-				fmt.Fprintf(&sortedGenomeFile, "%s\t%d\n", chr, size)
-				delete(chrSize, chr)
+			if chrSize[chr] == 0 {
+				chrSize[chr] = size
 			}
 		}
-
-		// The bcftools --mask argument needs to end in ".bed"
-		// in order to be parsed as a BED file, so we need to
-		// use a named pipe instead of stdin.
-		tempdir, err := ioutil.TempDir("", "")
-		if err != nil {
-			return fmt.Errorf("TempDir: %s", err)
-		}
-		defer os.RemoveAll(tempdir)
-		maskfifo = filepath.Join(tempdir, "fifo.bed")
-		err = syscall.Mkfifo(maskfifo, 0600)
-		if err != nil {
-			return fmt.Errorf("mkfifo: %s", err)
-		}
-
-		// bedtools complement can't seem to read from a pipe
-		// reliably -- "Error: line number 1 of file
-		// /dev/stdin has 1 fields, but 3 were expected." --
-		// so we stage to a temp file.
-		regionsFile := filepath.Join(tempdir, "gvcf_regions.bed")
-		err = ioutil.WriteFile(regionsFile, regions.Bytes(), 0644)
-		if err != nil {
-			return err
+		if err = scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error scanning genome file %q: %s", cmd.genomeFile, err)
 		}
-
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			maskfifow, err := os.OpenFile(maskfifo, os.O_WRONLY, 0)
-			if err != nil {
-				errs <- err
-				return
-			}
-			defer maskfifow.Close()
-
-			bedcompargs := []string{"bedtools", "complement", "-i", regionsFile, "-g", "/dev/stdin"}
-			bedcompargs = maybeInDocker(bedcompargs, []string{cmd.genomeFile})
-			bedcomp := exec.CommandContext(ctx, bedcompargs[0], bedcompargs[1:]...)
-			bedcomp.Stdin = &sortedGenomeFile
-			bedcomp.Stdout = maskfifow
-			bedcomp.Stderr = cmd.stderr
-			log.Printf("running %v", bedcomp.Args)
-			err = bedcomp.Run()
-			log.Printf("exited %v", bedcomp.Args)
-			if err != nil {
-				errs <- fmt.Errorf("bedtools complement: %s", err)
-				return
-			}
-			err = maskfifow.Close()
-			if err != nil {
-				errs <- err
-				return
-			}
-		}()
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		consargs := []string{"bcftools", "consensus", "--fasta-ref", cmd.refFile, "-H", fmt.Sprint(phase)}
-		if maskfifo != "" {
-			consargs = append(consargs, "--mask", maskfifo)
-		}
-		consargs = append(consargs, infile)
-		indexsuffix := ".tbi"
-		if _, err := os.Stat(infile + ".csi"); err == nil {
-			indexsuffix = ".csi"
-		}
-		mounts := []string{infile, infile + indexsuffix, cmd.refFile}
-		if maskfifo != "" {
-			mounts = append(mounts, maskfifo)
-		}
-		consargs = maybeInDocker(consargs, mounts)
-
-		consensus := exec.CommandContext(ctx, consargs[0], consargs[1:]...)
-		consensus.Stderr = os.Stderr
-		consensus.Stdout = gzipw
-		consensus.Stderr = cmd.stderr
-		log.Printf("running %v", consensus.Args)
-		err = consensus.Run()
+	// "bedtools complement" expects the chromosome sizes
+	// ("genome file") to appear in the same order as the
+	// chromosomes in the input vcf, so we need to sort
+	// them.
+	scanner = bufio.NewScanner(bytes.NewBuffer(append([]byte(nil), regions.Bytes()...)))
+	var sortedGenomeFile bytes.Buffer
+	for scanner.Scan() {
+		var chr string
+		var size int
+		_, err := fmt.Sscanf(scanner.Text(), "%s\t%d", &chr, &size)
 		if err != nil {
-			errs <- fmt.Errorf("bcftools consensus: %s", err)
-			return
+			return nil, fmt.Errorf("error parsing gvcf_regions output: %s", err)
 		}
-		err = gzipw.Close()
-		if err != nil {
-			errs <- err
-			return
+		if size, ok := chrSize[chr]; ok {
+			fmt.Fprintf(&sortedGenomeFile, "%s\t%d\n", chr, size)
+			delete(chrSize, chr)
 		}
-		errs <- outf.Close()
-	}()
+	}
 
-	go func() {
-		wg.Wait()
-		close(errs)
-	}()
+	tempdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, fmt.Errorf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(tempdir)
 
-	for err := range errs {
-		if err != nil {
-			cancel()
-			wg.Wait()
-			return err
-		}
+	// bedtools complement can't seem to read from a pipe
+	// reliably -- "Error: line number 1 of file
+	// /dev/stdin has 1 fields, but 3 were expected." --
+	// so we stage to a temp file.
+	regionsFile := filepath.Join(tempdir, "gvcf_regions.bed")
+	err = ioutil.WriteFile(regionsFile, regions.Bytes(), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	var mask bytes.Buffer
+	bedcompargs := []string{"bedtools", "complement", "-i", regionsFile, "-g", "/dev/stdin"}
+	bedcompargs = maybeInDocker(bedcompargs, []string{cmd.genomeFile})
+	bedcomp := exec.CommandContext(ctx, bedcompargs[0], bedcompargs[1:]...)
+	bedcomp.Stdin = &sortedGenomeFile
+	bedcomp.Stdout = &mask
+	bedcomp.Stderr = cmd.stderr
+	log.Printf("running %v", bedcomp.Args)
+	err = bedcomp.Run()
+	log.Printf("exited %v", bedcomp.Args)
+	if err != nil {
+		return nil, fmt.Errorf("bedtools complement: %s", err)
+	}
+	masked, err := readBED(&mask)
+	if err != nil {
+		return nil, fmt.Errorf("bedtools complement: %s", err)
 	}
-	return nil
+	return masked, nil
 }
 
 func (cmd *vcf2fasta) loadRegionsPy() error {
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type vcfSuite struct{}
+
+var _ = check.Suite(&vcfSuite{})
+
+// Expected consensus sequences for testdata/b.vcf applied to
+// testdata/ref, haplotypes 1 and 2. These must be the output of
+// "bcftools consensus -H 1" and "-H 2": regenerate them with
+// testdata/b.consensus.sh. TestConsensusBcftools also checks them
+// against bcftools when it is installed.
+var bVCFConsensus = func() []string {
+	var seqs []string
+	for phase := 1; phase <= 2; phase++ {
+		buf, err := ioutil.ReadFile(fmt.Sprintf("testdata/b.consensus.%d.fasta", phase))
+		if err != nil {
+			panic(err)
+		}
+		seqs = append(seqs, string(buf))
+	}
+	return seqs
+}()
+
+func (s *vcfSuite) consensus(c *check.C, vcffile, reffile string, phase int) (string, error) {
+	vf, err := openVCF(vcffile)
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	err = (&vcfConsensus{
+		vcfs:       []*vcfFile{vf},
+		refFile:    reffile,
+		haplotypes: []*vcfHaplotype{{phase: phase, w: &buf}},
+	}).writeFasta()
+	return buf.String(), err
+}
+
+func (s *vcfSuite) TestConsensus(c *check.C) {
+	for phase := 1; phase <= 2; phase++ {
+		out, err := s.consensus(c, "testdata/b.vcf", "testdata/ref", phase)
+		c.Check(err, check.IsNil)
+		c.Check(out, check.Equals, bVCFConsensus[phase-1])
+	}
+}
+
+// writeTwoSampleVCF writes a copy of testdata/b.vcf with a second
+// sample, "sample2", whose haplotypes are those of sample1 in the
+// opposite order. Unphased genotypes are still unphased.
+func writeTwoSampleVCF(c *check.C, filename string) {
+	vcf, err := ioutil.ReadFile("testdata/b.vcf")
+	c.Assert(err, check.IsNil)
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(vcf), "\n") {
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		} else if strings.HasPrefix(line, "##") {
+			fmt.Fprintln(&out, line)
+			continue
+		} else if strings.HasPrefix(line, "#") {
+			fmt.Fprintln(&out, line+"\tsample2")
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		sample := strings.Split(fields[9], ":")
+		for i, key := range strings.Split(fields[8], ":") {
+			if key != "GT" {
+				continue
+			}
+			if sep := strings.IndexAny(sample[i], "/|"); sep >= 0 {
+				sample[i] = sample[i][sep+1:] + sample[i][sep:sep+1] + sample[i][:sep]
+			}
+		}
+		fmt.Fprintln(&out, line+"\t"+strings.Join(sample, ":"))
+	}
+	err = ioutil.WriteFile(filename, out.Bytes(), 0644)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *vcfSuite) TestConsensusMultiSample(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	writeTwoSampleVCF(c, tmpdir+"/two.vcf")
+	vf, err := openVCF(tmpdir + "/two.vcf")
+	c.Assert(err, check.IsNil)
+	c.Check(vf.samples, check.DeepEquals, []string{"sample1", "sample2"})
+	// All four haplotypes are written in a single pass.
+	var bufs [4]bytes.Buffer
+	vc := &vcfConsensus{vcfs: []*vcfFile{vf}, refFile: "testdata/ref"}
+	for sample := 0; sample < 2; sample++ {
+		for phase := 1; phase <= 2; phase++ {
+			vc.haplotypes = append(vc.haplotypes, &vcfHaplotype{sample: sample, phase: phase, w: &bufs[sample*2+phase-1]})
+		}
+	}
+	err = vc.writeFasta()
+	c.Check(err, check.IsNil)
+	for sample := 0; sample < 2; sample++ {
+		for phase := 1; phase <= 2; phase++ {
+			expect := bVCFConsensus[phase-1]
+			if sample == 1 {
+				expect = bVCFConsensus[2-phase]
+			}
+			c.Check(bufs[sample*2+phase-1].String(), check.Equals, expect, check.Commentf("sample %d phase %d", sample, phase))
+		}
+	}
+}
+
+func (s *vcfSuite) TestConsensusIndexed(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+
+	ref, err := ioutil.ReadFile("testdata/ref")
+	c.Assert(err, check.IsNil)
+	ref = append(ref, ">chr2 second sequence\nACGTACGTAC\nGTACGT\n"...)
+	err = ioutil.WriteFile(tmpdir+"/ref.fasta", ref, 0644)
+	c.Assert(err, check.IsNil)
+
+	vcf, err := ioutil.ReadFile("testdata/b.vcf")
+	c.Assert(err, check.IsNil)
+	lines := strings.SplitAfter(string(vcf), "\n")
+	var header, chr1 string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			header += line
+		} else {
+			chr1 += line
+		}
+	}
+	header = strings.Replace(header, "##contig=<ID=chr1", "##contig=<ID=chr2,length=16>\n##contig=<ID=chr1", 1)
+	// In the VCF file, chr2 comes before chr1, so the index is
+	// needed to read the chromosomes in reference order. Without
+	// an index, this is an error.
+	chr2 := "chr2\t5\t.\tA\tG\t50\tPASS\t.\tGT\t1|0\n"
+	expect := []string{
+		bVCFConsensus[0] + ">chr2 second sequence\nACGTGCGTAC\nGTACGT\n",
+		bVCFConsensus[1] + ">chr2 second sequence\nACGTACGTAC\nGTACGT\n",
+	}
+
+	// unindexed
+	err = ioutil.WriteFile(tmpdir+"/plain.vcf", []byte(header+chr2+chr1), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = s.consensus(c, tmpdir+"/plain.vcf", tmpdir+"/ref.fasta", 1)
+	c.Check(err, check.ErrorMatches, `.*/plain.vcf: records for chr1 are not in the same order as the reference sequences.*`)
+
+	// unindexed, in reference order
+	err = ioutil.WriteFile(tmpdir+"/sorted.vcf", []byte(header+chr1+chr2), 0644)
+	c.Assert(err, check.IsNil)
+	for phase := 1; phase <= 2; phase++ {
+		out, err := s.consensus(c, tmpdir+"/sorted.vcf", tmpdir+"/ref.fasta", phase)
+		c.Check(err, check.IsNil)
+		c.Check(out, check.Equals, expect[phase-1])
+	}
+
+	// unindexed, with records for a sequence that is not in the
+	// reference: they are ignored if they come last, otherwise
+	// the error says which sequence is in the way.
+	chrUn := "chrUn_1\t5\t.\tA\tG\t50\tPASS\t.\tGT\t1|0\n"
+	err = ioutil.WriteFile(tmpdir+"/unplaced-last.vcf", []byte(header+chr1+chr2+chrUn), 0644)
+	c.Assert(err, check.IsNil)
+	out, err := s.consensus(c, tmpdir+"/unplaced-last.vcf", tmpdir+"/ref.fasta", 1)
+	c.Check(err, check.IsNil)
+	c.Check(out, check.Equals, expect[0])
+	err = ioutil.WriteFile(tmpdir+"/unplaced.vcf", []byte(header+chr1+chrUn+chr2), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = s.consensus(c, tmpdir+"/unplaced.vcf", tmpdir+"/ref.fasta", 1)
+	c.Check(err, check.ErrorMatches, `.*/unplaced.vcf: records for chr2 come after records for chrUn_1, which is not in the reference .*`)
+
+	for _, format := range []string{"tbi", "csi"} {
+		vcffile := tmpdir + "/" + format + ".vcf.gz"
+		writeIndexedVCF(c, vcffile, format, header, []string{"chr2", "chr1"}, []string{chr2, chr1})
+		vf, err := openVCF(vcffile)
+		c.Assert(err, check.IsNil)
+		c.Check(vf.offset, check.HasLen, 2)
+		for phase := 1; phase <= 2; phase++ {
+			out, err := s.consensus(c, vcffile, tmpdir+"/ref.fasta", phase)
+			c.Check(err, check.IsNil)
+			c.Check(out, check.Equals, expect[phase-1], check.Commentf("%s phase %d", format, phase))
+		}
+	}
+}
+
+// writeIndexedVCF writes a gzipped VCF file with each chromosome's
+// records in a separate gzip member (like bgzip, but without the
+// block size limit), and a minimal tabix or CSI index.
+func writeIndexedVCF(c *check.C, filename, format, header string, chroms, records []string) {
+	var vcf bytes.Buffer
+	var offsets []uint64
+	for i, data := range append([]string{header}, records...) {
+		if i > 0 {
+			offsets = append(offsets, uint64(vcf.Len())<<16)
+		}
+		gz := gzip.NewWriter(&vcf)
+		gz.Write([]byte(data))
+		c.Assert(gz.Close(), check.IsNil)
+	}
+	err := ioutil.WriteFile(filename, vcf.Bytes(), 0644)
+	c.Assert(err, check.IsNil)
+
+	var names []byte
+	for _, chrom := range chroms {
+		names = append(append(names, chrom...), 0)
+	}
+	var idx bytes.Buffer
+	w := func(data ...interface{}) {
+		for _, d := range data {
+			c.Assert(binary.Write(&idx, binary.LittleEndian, d), check.IsNil)
+		}
+	}
+	conf := []int32{2, 1, 2, 0, '#', 0, int32(len(names))}
+	if format == "tbi" {
+		w([]byte("TBI\x01"), int32(len(chroms)), conf, names)
+	} else {
+		w([]byte("CSI\x01"), int32(14), int32(5), int32(len(conf)*4+len(names)), conf, names, int32(len(chroms)))
+	}
+	for i := range chroms {
+		w(int32(2)) // bins
+		for _, bin := range []uint32{4681, 37450} {
+			w(bin)
+			if format == "csi" {
+				w(offsets[i])
+			}
+			if bin == 37450 {
+				// pseudo-bin: offsets, then record counts
+				w(int32(2), offsets[i], offsets[i]+1, uint64(3), uint64(0))
+			} else {
+				w(int32(1), offsets[i], offsets[i]+1)
+			}
+		}
+		if format == "tbi" {
+			w(int32(1), offsets[i])
+		}
+	}
+	f, err := os.Create(filename + "." + format)
+	c.Assert(err, check.IsNil)
+	gz := gzip.NewWriter(f)
+	_, err = gz.Write(idx.Bytes())
+	c.Assert(err, check.IsNil)
+	c.Assert(gz.Close(), check.IsNil)
+	c.Assert(f.Close(), check.IsNil)
+}
+
+func (s *vcfSuite) TestConsensusMask(c *check.C) {
+	vf, err := openVCF("testdata/b.vcf")
+	c.Assert(err, check.IsNil)
+	mask, err := readBED(bytes.NewBufferString("chr1\t24\t27\nchr1\t0\t10\nchr2\t0\t10\n"))
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	err = (&vcfConsensus{
+		vcfs:       []*vcfFile{vf},
+		refFile:    "testdata/ref",
+		mask:       mask,
+		haplotypes: []*vcfHaplotype{{phase: 2, w: &buf}},
+	}).writeFasta()
+	c.Assert(err, check.IsNil)
+	// Variants at 3 and 26 are masked. The variant at 30 is not.
+	c.Check(strings.Split(buf.String(), "\n")[1:3], check.DeepEquals, []string{
+		"NNNNNNNNNNGCTCCGCCTTCAGA",
+		"NNNtgaactgtgagcgcatctgca",
+	})
+}
+
+// TestConsensusBcftools checks the consensus sequences, with and
+// without a mask, against "bcftools consensus". It is skipped if
+// bcftools is not installed.
+func (s *vcfSuite) TestConsensusBcftools(c *check.C) {
+	if _, err := exec.LookPath("bcftools"); err != nil {
+		c.Skip("bcftools not found in PATH")
+	}
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	vcfgz := tmpdir + "/b.vcf.gz"
+	for _, args := range [][]string{
+		{"view", "-Oz", "-o", vcfgz, "testdata/b.vcf"},
+		{"index", vcfgz},
+	} {
+		out, err := exec.Command("bcftools", args...).CombinedOutput()
+		c.Assert(err, check.IsNil, check.Commentf("bcftools %v: %s", args, out))
+	}
+	maskBED := "chr1\t24\t27\nchr1\t0\t10\nchr1\t340\t352\n"
+	maskfile := tmpdir + "/mask.bed"
+	err = ioutil.WriteFile(maskfile, []byte(maskBED), 0644)
+	c.Assert(err, check.IsNil)
+	mask, err := readBED(bytes.NewBufferString(maskBED))
+	c.Assert(err, check.IsNil)
+
+	vf, err := openVCF("testdata/b.vcf")
+	c.Assert(err, check.IsNil)
+	for _, masked := range []bool{false, true} {
+		for phase := 1; phase <= 2; phase++ {
+			args := []string{"consensus", "-f", "testdata/ref", "-s", "sample1", "-H", fmt.Sprintf("%d", phase)}
+			var buf bytes.Buffer
+			vc := &vcfConsensus{vcfs: []*vcfFile{vf}, refFile: "testdata/ref", haplotypes: []*vcfHaplotype{{phase: phase, w: &buf}}}
+			if masked {
+				args = append(args, "-m", maskfile)
+				vc.mask = mask
+			}
+			args = append(args, vcfgz)
+			cmd := exec.Command("bcftools", args...)
+			cmd.Stderr = os.Stderr
+			expect, err := cmd.Output()
+			c.Assert(err, check.IsNil, check.Commentf("bcftools %v", args))
+			err = vc.writeFasta()
+			c.Assert(err, check.IsNil)
+			c.Check(buf.String(), check.Equals, string(expect), check.Commentf("masked=%v phase=%d", masked, phase))
+			if !masked {
+				c.Check(bVCFConsensus[phase-1], check.Equals, string(expect), check.Commentf("phase=%d", phase))
+			}
+		}
+	}
+}
+
+func (s *vcfSuite) TestConsensusRefMismatch(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	err = ioutil.WriteFile(tmpdir+"/bad.vcf", []byte("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tsample1\nchr1\t3\t.\tC\tG\t50\tPASS\t.\tGT\t1|1\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = s.consensus(c, tmpdir+"/bad.vcf", "testdata/ref", 1)
+	c.Check(err, check.ErrorMatches, `chr1:3: REF allele "C" does not match reference sequence "A"`)
+}
+
+func (s *vcfSuite) TestConsensusUnsorted(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	err = ioutil.WriteFile(tmpdir+"/unsorted.vcf", []byte("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tsample1\nchr1\t26\t.\tC\tT\t50\tPASS\t.\tGT\t1|1\nchr1\t3\t.\tA\tG\t50\tPASS\t.\tGT\t1|1\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = s.consensus(c, tmpdir+"/unsorted.vcf", "testdata/ref", 1)
+	c.Check(err, check.ErrorMatches, `chr1:3: record is out of order \(previous record was at chr1:26\), VCF file must be sorted by position`)
+}
+
+func (s *vcfSuite) TestImportVCF(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	for phase := 1; phase <= 2; phase++ {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/b.%d.fasta", tmpdir, phase), []byte(bVCFConsensus[phase-1]), 0644)
+		c.Assert(err, check.IsNil)
+	}
+	var genomes [][]CompactGenome
+	for _, infile := range []string{"testdata/b.vcf", tmpdir + "/b.1.fasta"} {
+		var buffer bytes.Buffer
+		exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", "testdata/ref", infile}, &bytes.Buffer{}, &buffer, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+		var cgs []CompactGenome
+		err = DecodeLibrary(&buffer, func(ent *LibraryEntry) error {
+			cgs = append(cgs, ent.CompactGenomes...)
+			return nil
+		})
+		c.Assert(err, check.IsNil)
+		c.Assert(cgs, check.HasLen, 1)
+		genomes = append(genomes, cgs)
+	}
+	c.Check(genomes[0][0].Name, check.Equals, "sample1")
+	c.Check(genomes[0][0].Variants, check.DeepEquals, genomes[1][0].Variants)
+}
+
+func (s *vcfSuite) TestImportAppendVCF(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", "testdata/ref", "-o", tmpdir + "/b.gob", "testdata/b.vcf"}, &bytes.Buffer{}, &bytes.Buffer{}, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+
+	// sample1 is already in the library, and sample2 is not.
+	writeTwoSampleVCF(c, tmpdir+"/two.vcf")
+	var stderr bytes.Buffer
+	exited = (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", "testdata/ref", "-append", tmpdir + "/b.gob", "-o", tmpdir + "/two.gob", tmpdir + "/two.vcf"}, &bytes.Buffer{}, &bytes.Buffer{}, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `(?s).*genome "sample1" \(from .*/two.vcf\) is already in the library.*`)
+}
+
+func (s *vcfSuite) TestImportMultiSample(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	writeTwoSampleVCF(c, tmpdir+"/two.vcf")
+	var buffer bytes.Buffer
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", "testdata/ref", tmpdir}, &bytes.Buffer{}, &buffer, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	cgs := map[string]CompactGenome{}
+	err = DecodeLibrary(bytes.NewReader(buffer.Bytes()), func(ent *LibraryEntry) error {
+		for _, cg := range ent.CompactGenomes {
+			cgs[cg.Name] = cg
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(cgs, check.HasLen, 2)
+	cg1, cg2 := cgs["sample1"], cgs["sample2"]
+	c.Assert(cg1.Variants, check.HasLen, len(cg2.Variants))
+	for i := 0; i < len(cg1.Variants); i += 2 {
+		c.Check(cg2.Variants[i:i+2], check.DeepEquals, []tileVariantID{cg1.Variants[i+1], cg1.Variants[i]})
+	}
+
+	// Unphased heterozygous variants at 49 (tiles 0 and 1), 100
+	// (tiles 1 and 2), and 250 (tiles 4 and 5).
+	c.Check(cg1.UnphasedTags, check.DeepEquals, []tagID{0, 1, 2, 4, 5})
+	c.Check(cg2.UnphasedTags, check.DeepEquals, cg1.UnphasedTags)
+
+	// After canonicalPhase, the two samples differ only in the
+	// phased tiles, where their haplotypes are swapped.
+	cg1.canonicalPhase()
+	cg2.canonicalPhase()
+	unphased := map[int]bool{}
+	for _, tag := range cg1.UnphasedTags {
+		unphased[int(tag)] = true
+	}
+	for i := 0; i < len(cg1.Variants); i += 2 {
+		if unphased[i/2] {
+			c.Check(cg2.Variants[i:i+2], check.DeepEquals, cg1.Variants[i:i+2], check.Commentf("tag %d", i/2))
+		} else {
+			c.Check(cg2.Variants[i:i+2], check.DeepEquals, []tileVariantID{cg1.Variants[i+1], cg1.Variants[i]}, check.Commentf("tag %d", i/2))
+		}
+	}
+
+	var exported bytes.Buffer
+	exited = (&exportFasta{}).RunCommand("export-fasta", []string{"-local=true", "-canonical-phase"}, bytes.NewReader(buffer.Bytes()), &exported, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	c.Check(strings.Count(exported.String(), ">"), check.Equals, 4)
+}
+
+// TestImportPerChromosome checks that VCF files with the same
+// samples, each with records for different chromosomes, are imported
+// as one genome per sample.
+func (s *vcfSuite) TestImportPerChromosome(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+
+	// Split the reference after the 7th line (168 bases), where
+	// there are no variants nearby, into chr1 and chr2.
+	ref, err := ioutil.ReadFile("testdata/ref")
+	c.Assert(err, check.IsNil)
+	reflines := strings.SplitAfter(string(ref), "\n")
+	err = ioutil.WriteFile(tmpdir+"/ref.fasta", []byte(strings.Join(reflines[:8], "")+">chr2\n"+strings.Join(reflines[8:], "")), 0644)
+	c.Assert(err, check.IsNil)
+
+	writeTwoSampleVCF(c, tmpdir+"/two.vcf")
+	vcf, err := ioutil.ReadFile(tmpdir + "/two.vcf")
+	c.Assert(err, check.IsNil)
+	var header, chr1, chr2 string
+	for _, line := range strings.SplitAfter(string(vcf), "\n") {
+		fields := strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#") || len(fields) < 2 {
+			header += line
+			continue
+		}
+		pos, err := strconv.Atoi(fields[1])
+		c.Assert(err, check.IsNil)
+		if pos <= 168 {
+			chr1 += line
+		} else {
+			fields[0], fields[1] = "chr2", strconv.Itoa(pos-168)
+			chr2 += strings.Join(fields, "\t")
+		}
+	}
+	c.Assert(chr1, check.Not(check.Equals), "")
+	c.Assert(chr2, check.Not(check.Equals), "")
+	for _, dir := range []string{"all", "chr1", "split"} {
+		c.Assert(os.Mkdir(tmpdir+"/"+dir, 0755), check.IsNil)
+	}
+	for fnm, data := range map[string]string{
+		"all/all.vcf":      header + chr1 + chr2,
+		"chr1/chr1.vcf":    header + chr1,
+		"split/chr1.vcf":   header + chr1,
+		"split/chr2.vcf":   header + chr2,
+		"dup/two.vcf":      header + chr1 + chr2,
+		"dup/one.vcf":      strings.Replace(header, "\tsample2", "", 1),
+		"overlap/chr1.vcf": header + chr1,
+		"overlap/all.vcf":  header + chr1 + chr2,
+	} {
+		os.MkdirAll(tmpdir+"/"+filepath.Dir(fnm), 0755)
+		err = ioutil.WriteFile(tmpdir+"/"+fnm, []byte(data), 0644)
+		c.Assert(err, check.IsNil)
+	}
+
+	genomes := map[string]map[string]CompactGenome{}
+	for _, dir := range []string{"all", "chr1", "split"} {
+		var buffer bytes.Buffer
+		exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", tmpdir + "/ref.fasta", tmpdir + "/" + dir}, &bytes.Buffer{}, &buffer, os.Stderr)
+		c.Assert(exited, check.Equals, 0)
+		genomes[dir] = map[string]CompactGenome{}
+		err = DecodeLibrary(bytes.NewReader(buffer.Bytes()), func(ent *LibraryEntry) error {
+			for _, cg := range ent.CompactGenomes {
+				genomes[dir][cg.Name] = cg
+			}
+			return nil
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(genomes[dir], check.HasLen, 2, check.Commentf("%s", dir))
+	}
+	for _, name := range []string{"sample1", "sample2"} {
+		c.Check(genomes["split"][name], check.DeepEquals, genomes["all"][name])
+		c.Check(genomes["chr1"][name].Variants, check.Not(check.DeepEquals), genomes["all"][name].Variants)
+	}
+
+	// A sample name that appears in VCF files with different
+	// samples is an error.
+	var stderr bytes.Buffer
+	exited := (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", tmpdir + "/ref.fasta", tmpdir + "/dup"}, &bytes.Buffer{}, &bytes.Buffer{}, &stderr)
+	c.Check(exited, check.Not(check.Equals), 0)
+	c.Check(stderr.String(), check.Matches, `(?s).*duplicate genome name "sample1" \(from .*/one.vcf and .*/two.vcf\).*`)
+
+	// VCF files with the same samples must not have records for
+	// the same chromosome.
+	stderr.Reset()
+	exited = (&importer{}).RunCommand("import", []string{"-local=true", "-tag-library", "testdata/tags", "-ref", tmpdir + "/ref.fasta", tmpdir + "/overlap"}, &bytes.Buffer{}, &bytes.Buffer{}, &stderr)
+	c.Check(exited, check.Not(check.Equals), 0)
+	c.Check(stderr.String(), check.Matches, `(?s).*/all.vcf and .*/chr1.vcf both have records for chr1.*`)
+}
+
+func (s *vcfSuite) TestVcf2fasta(c *check.C) {
+	tmpdir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpdir)
+	writeTwoSampleVCF(c, tmpdir+"/two.vcf")
+	// An existing output file is replaced, not partly
+	// overwritten.
+	err = ioutil.WriteFile(tmpdir+"/b.vcf.sample1.1.fasta.gz", bytes.Repeat([]byte("x"), 100000), 0644)
+	c.Assert(err, check.IsNil)
+	exited := (&vcf2fasta{}).RunCommand("vcf2fasta", []string{"-local=true", "-ref", "testdata/ref", "-output-dir", tmpdir, tmpdir + "/two.vcf", "testdata/b.vcf"}, &bytes.Buffer{}, &bytes.Buffer{}, os.Stderr)
+	c.Assert(exited, check.Equals, 0)
+	for _, sample := range []string{"sample1", "sample2"} {
+		for phase := 1; phase <= 2; phase++ {
+			expect := bVCFConsensus[phase-1]
+			if sample == "sample2" {
+				expect = bVCFConsensus[2-phase]
+			}
+			c.Check(readGzipFile(c, fmt.Sprintf("%s/two.vcf.%s.%d.fasta.gz", tmpdir, sample, phase)), check.Equals, expect)
+		}
+	}
+	// Output files for a single-sample input are also named
+	// after the sample.
+	for phase := 1; phase <= 2; phase++ {
+		c.Check(readGzipFile(c, fmt.Sprintf("%s/b.vcf.sample1.%d.fasta.gz", tmpdir, phase)), check.Equals, bVCFConsensus[phase-1])
+	}
+
+	// Input files with the same name would overwrite each
+	// other's output.
+	err = os.Mkdir(tmpdir+"/other", 0755)
+	c.Assert(err, check.IsNil)
+	writeTwoSampleVCF(c, tmpdir+"/other/two.vcf")
+	var stderr bytes.Buffer
+	exited = (&vcf2fasta{}).RunCommand("vcf2fasta", []string{"-local=true", "-ref", "testdata/ref", "-output-dir", tmpdir, tmpdir + "/two.vcf", tmpdir + "/other/two.vcf"}, &bytes.Buffer{}, &bytes.Buffer{}, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `(?s).*would both be written to output file .*/two.vcf.sample1.1.fasta.gz.*`)
+
+	// Sample names are not allowed to put output files outside
+	// the output directory.
+	vcf, err := ioutil.ReadFile("testdata/b.vcf")
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(tmpdir+"/other/slash.vcf", bytes.Replace(vcf, []byte("\tsample1\n"), []byte("\t../../sample1\n"), 1), 0644)
+	c.Assert(err, check.IsNil)
+	stderr.Reset()
+	exited = (&vcf2fasta{}).RunCommand("vcf2fasta", []string{"-local=true", "-ref", "testdata/ref", "-output-dir", tmpdir + "/other", tmpdir + "/other/slash.vcf"}, &bytes.Buffer{}, &bytes.Buffer{}, &stderr)
+	c.Check(exited, check.Equals, 1)
+	c.Check(stderr.String(), check.Matches, `(?s).*slash.vcf: sample name "../../sample1" cannot be used in an output file name.*`)
+}
+
+func readGzipFile(c *check.C, filename string) string {
+	f, err := os.Open(filename)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(gz)
+	c.Assert(err, check.IsNil)
+	return string(buf)
+}